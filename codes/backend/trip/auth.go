@@ -0,0 +1,176 @@
+// auth.go
+
+package main
+
+// import the necessary packages
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// tokenIssuer identifies the user service, which issues every access token accepted here
+const tokenIssuer = "carpool-user-service"
+
+// tokenSecret is the HMAC key shared with the user service, read from the JWT_SECRET environment variable
+var tokenSecret []byte
+
+// TokenClaims represents the claims carried by an access token
+type TokenClaims struct {
+	UserType string `json:"UserType"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the user ID stored in the token subject
+func (c *TokenClaims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+// contextKey is the type of the keys stored in the request context by the middleware
+type contextKey string
+
+// claimsContextKey stores the verified token claims of the caller
+const claimsContextKey contextKey = "claims"
+
+// loadTokenConfig reads the token verification key from the environment
+func loadTokenConfig() {
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) < 32 {
+		log.Fatal("JWT_SECRET must be set to the same value as the user service")
+	}
+	tokenSecret = []byte(secret)
+}
+
+// parseAccessToken verifies the signature and expiry of an access token and returns its claims
+func parseAccessToken(tokenString string) (*TokenClaims, error) {
+	var claims TokenClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		return tokenSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	// Every token issued by the user service carries a numeric subject
+	if _, err := claims.UserID(); err != nil {
+		return nil, errors.New("token subject is not a user ID")
+	}
+	return &claims, nil
+}
+
+// sessionActive reports whether the session of a token has been neither revoked nor expired, and refreshes its LastSeen.
+// The role of the token is replaced by the one stored for the user, so that a role change applies before the token expires.
+func sessionActive(claims *TokenClaims) (bool, error) {
+	now := time.Now()
+	var userType string
+	err := db.QueryRow(`
+		SELECT u.UserType FROM CarPoolSession s
+		JOIN CarPoolUser u ON s.UserID = u.UserID
+		WHERE s.SessionID = ? AND s.UserID = ? AND s.RevocationDate IS NULL AND s.ExpiryDate > ?
+			AND u.DeletionDate IS NULL AND u.SuspendedDate IS NULL`,
+		claims.ID, claims.Subject, now.Format(dateTimeLayout),
+	).Scan(&userType)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	claims.UserType = userType
+
+	// Only write LastSeen once per minute to keep authenticated reads cheap
+	_, err = db.Exec(
+		"UPDATE CarPoolSession SET LastSeen = ? WHERE SessionID = ? AND LastSeen < ?",
+		now.Format(dateTimeLayout), claims.ID, now.Add(-time.Minute).Format(dateTimeLayout),
+	)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return true, nil
+}
+
+// requireAuth rejects requests that do not carry a valid bearer access token
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the token from the Authorization header
+		tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || tokenString == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Missing access token", http.StatusUnauthorized)
+			return
+		}
+
+		// Verify the token and keep its claims for the handlers
+		claims, err := parseAccessToken(tokenString)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Invalid or expired access token", http.StatusUnauthorized)
+			return
+		}
+
+		// Reject tokens of sessions that were logged out or revoked in the user service
+		active, err := sessionActive(claims)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !active {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	}
+}
+
+// requireSelf rejects requests whose {userID} path variable does not match the subject of the access token,
+// unless the caller is a moderator allowed to access any user
+func requireSelf(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r)
+		if claims == nil || (mux.Vars(r)["userID"] != claims.Subject && !can(claims.UserType, actionAccessAnyUser)) {
+			http.Error(w, "You are not allowed to access this user", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireVerifiedEmail rejects requests from accounts that have not verified their email address yet
+func requireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// The verification is read from the user table, so it takes effect without a new token
+		var verifiedDate sql.NullString
+		err := db.QueryRow("SELECT EmailVerifiedDate FROM CarPoolUser WHERE UserID = ?", claimsFromContext(r).Subject).Scan(&verifiedDate)
+		if err != nil && err != sql.ErrNoRows {
+			fmt.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !verifiedDate.Valid {
+			http.Error(w, "Verify your email address before booking or publishing trips", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// claimsFromContext returns the token claims stored by requireAuth, or nil if the request is unauthenticated
+func claimsFromContext(r *http.Request) *TokenClaims {
+	claims, _ := r.Context().Value(claimsContextKey).(*TokenClaims)
+	return claims
+}
@@ -0,0 +1,118 @@
+// booking.go
+
+package main
+
+// import the necessary packages
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a booking, cancelled bookings are kept so that the car owner can see them
+const (
+	bookingBooked           = "booked"
+	bookingCancelled        = "cancelled"
+	bookingCancelledByOwner = "cancelled by owner"
+)
+
+// bookingCancelCutoff is how long before the start of a trip passengers can still cancel, set with BOOKING_CANCEL_CUTOFF
+var bookingCancelCutoff = time.Hour
+
+// loadBookingConfig reads the cancellation cut-off from BOOKING_CANCEL_CUTOFF, such as "2h" or "30m"
+func loadBookingConfig() {
+	if value := os.Getenv("BOOKING_CANCEL_CUTOFF"); value != "" {
+		cutoff, err := time.ParseDuration(value)
+		if err != nil || cutoff < 0 {
+			log.Fatal("BOOKING_CANCEL_CUTOFF must be a duration such as 2h or 30m")
+		}
+		bookingCancelCutoff = cutoff
+	}
+}
+
+// cancelBooking lets a passenger cancel their booking before the cut-off and gives the seat back to the trip
+func cancelBooking(w http.ResponseWriter, r *http.Request) {
+	// Extract the booking ID from the request parameters
+	params := mux.Vars(r)
+	bookingID, err := strconv.Atoi(params["bookingID"])
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	// Lock the booking and its trip, so that the seat is given back exactly once
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var booking Booking
+	var tripStatus, startDateTime string
+	err = tx.QueryRow(`
+		SELECT cb.BookingID, cb.TripID, cb.PassengerID, cb.BookingDateTime, cb.BookingStatus, ct.TripStatus, ct.StartDateTime
+		FROM CarPoolBooking cb
+		JOIN CarPoolTrip ct ON cb.TripID = ct.TripID
+		WHERE cb.BookingID = ? FOR UPDATE`, bookingID).Scan(
+		&booking.BookingID, &booking.TripID, &booking.PassengerID, &booking.BookingDateTime, &booking.BookingStatus, &tripStatus, &startDateTime,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Booking not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Only the passenger who made the booking can cancel it
+	if strconv.Itoa(booking.PassengerID) != claimsFromContext(r).Subject {
+		http.Error(w, "You can only cancel your own bookings", http.StatusForbidden)
+		return
+	}
+	if booking.BookingStatus != bookingBooked {
+		http.Error(w, "Booking is already cancelled", http.StatusConflict)
+		return
+	}
+	if tripStatus != "created" && tripStatus != "fully booked" {
+		http.Error(w, "Bookings can only be cancelled before the trip starts", http.StatusConflict)
+		return
+	}
+	tripStart, err := parseTripTime(startDateTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if time.Now().After(tripStart.Add(-bookingCancelCutoff)) {
+		http.Error(w, fmt.Sprintf("Bookings can only be cancelled up to %s before the trip starts", bookingCancelCutoff), http.StatusConflict)
+		return
+	}
+
+	// Mark the booking as cancelled and reopen the seat, a full trip can be booked again
+	now := time.Now().Format(dateTimeLayout)
+	_, err = tx.Exec("UPDATE CarPoolBooking SET BookingStatus = ?, CancelledDateTime = ? WHERE BookingID = ?", bookingCancelled, now, booking.BookingID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE CarPoolTrip SET AvailableSeats = AvailableSeats + 1, TripStatus = IF(TripStatus = 'fully booked', 'created', TripStatus) WHERE TripID = ?", booking.TripID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return a response
+	booking.BookingStatus = bookingCancelled
+	booking.CancelledDateTime = sql.NullString{String: now, Valid: true}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(booking)
+}
@@ -3,7 +3,8 @@ module trip
 go 1.21.3
 
 require (
-	github.com/go-sql-driver/mysql v1.7.1 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/rs/cors v1.10.1 // indirect
+	github.com/go-sql-driver/mysql v1.7.1
+	github.com/golang-jwt/jwt/v5 v5.2.1
+	github.com/gorilla/mux v1.8.1
+	github.com/rs/cors v1.10.1
 )
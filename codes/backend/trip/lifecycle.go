@@ -0,0 +1,244 @@
+// lifecycle.go
+
+package main
+
+// import the necessary packages
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// tripActionWindow is how long before its start time a trip can be started or cancelled
+const tripActionWindow = 30 * time.Minute
+
+// maxStatusReason is the longest cancellation reason that is stored
+const maxStatusReason = 255
+
+// tripTransitions lists the statuses a trip can move to from each status
+var tripTransitions = map[string][]string{
+	"created":      {"started", "cancelled"},
+	"fully booked": {"started", "cancelled"},
+	"started":      {"completed"},
+	"completed":    {},
+	"cancelled":    {},
+	"expired":      {},
+}
+
+// TripStateResponse represents the lifecycle of a trip as returned after a transition
+type TripStateResponse struct {
+	TripID            int      `json:"TripID"`
+	TripStatus        string   `json:"TripStatus"`
+	StartDateTime     string   `json:"StartDateTime"`
+	StartedDateTime   *string  `json:"StartedDateTime"`
+	CompletedDateTime *string  `json:"CompletedDateTime"`
+	CancelledDateTime *string  `json:"CancelledDateTime"`
+	StatusReason      *string  `json:"StatusReason"`
+	AllowedNextStates []string `json:"AllowedNextStates"`
+}
+
+// TransitionError represents a transition that is not allowed, with the statuses the trip can move to instead
+type TransitionError struct {
+	Message           string   `json:"Message"`
+	TripStatus        string   `json:"TripStatus"`
+	AllowedNextStates []string `json:"AllowedNextStates"`
+}
+
+// canTransition reports whether a trip can move from one status to another
+func canTransition(from, to string) bool {
+	for _, next := range tripTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// writeTransitionError answers 409 Conflict with the statuses the trip can move to
+func writeTransitionError(w http.ResponseWriter, message, status string) {
+	allowed := tripTransitions[status]
+	if allowed == nil {
+		allowed = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(TransitionError{Message: message, TripStatus: status, AllowedNextStates: allowed})
+}
+
+// nullableText returns the JSON value of an optional column
+func nullableText(value sql.NullString) *string {
+	if !value.Valid {
+		return nil
+	}
+	return &value.String
+}
+
+// startTrip starts a trip within the window before its start time
+func startTrip(w http.ResponseWriter, r *http.Request) {
+	transitionTrip(w, r, "started", sql.NullString{})
+}
+
+// completeTrip completes a started trip
+func completeTrip(w http.ResponseWriter, r *http.Request) {
+	transitionTrip(w, r, "completed", sql.NullString{})
+}
+
+// cancelTrip cancels a trip within the window before its start time, with an optional Reason that is passed on to the passengers
+func cancelTrip(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Reason string `json:"Reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body.Reason = strings.TrimSpace(body.Reason)
+	if len(body.Reason) > maxStatusReason {
+		http.Error(w, fmt.Sprintf("Reason must be at most %d characters", maxStatusReason), http.StatusBadRequest)
+		return
+	}
+	transitionTrip(w, r, "cancelled", sql.NullString{String: body.Reason, Valid: body.Reason != ""})
+}
+
+// transitionTrip moves a trip to the given status after checking its owner, its current status and the time window.
+// The dates of the transition are set by the server, and cancelling a trip cancels its bookings and notifies the passengers.
+func transitionTrip(w http.ResponseWriter, r *http.Request, to string, reason sql.NullString) {
+	// Extract trip ID from the request parameters
+	params := mux.Vars(r)
+	tripID, err := strconv.Atoi(params["tripID"])
+	if err != nil {
+		http.Error(w, "Invalid trip ID", http.StatusBadRequest)
+		return
+	}
+
+	// Lock the trip, so that two transitions cannot both start from the same status
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID int
+	var trip TripStateResponse
+	var destination string
+	var started, completed, cancelled, statusReason sql.NullString
+	err = tx.QueryRow(
+		"SELECT TripID, UserID, TripStatus, StartDateTime, DestinationAddress, StartedDateTime, CompletedDateTime, CancelledDateTime, StatusReason FROM CarPoolTrip WHERE TripID = ? FOR UPDATE",
+		tripID,
+	).Scan(&trip.TripID, &ownerID, &trip.TripStatus, &trip.StartDateTime, &destination, &started, &completed, &cancelled, &statusReason)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Only the owner of the trip, or a moderator, may change it
+	claims := claimsFromContext(r)
+	if strconv.Itoa(ownerID) != claims.Subject && !can(claims.UserType, actionManageAnyTrip) {
+		http.Error(w, "You can only update your own trips", http.StatusForbidden)
+		return
+	}
+
+	if !canTransition(trip.TripStatus, to) {
+		writeTransitionError(w, "A "+trip.TripStatus+" trip cannot be "+to, trip.TripStatus)
+		return
+	}
+
+	// Trips are started or cancelled in the window before their start time
+	now := time.Now()
+	if to == "started" || to == "cancelled" {
+		tripStart, err := parseTripTime(trip.StartDateTime)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if now.Before(tripStart.Add(-tripActionWindow)) || now.After(tripStart) {
+			writeTransitionError(w, "Trips can only be started or cancelled in the 30 minutes before their start time", trip.TripStatus)
+			return
+		}
+	}
+
+	// Stamp the date of the transition, in Singapore time like the start time it is compared with
+	stamp := sql.NullString{String: now.In(tripLocation).Format(dateTimeLayout), Valid: true}
+	switch to {
+	case "started":
+		started = stamp
+	case "completed":
+		completed = stamp
+	case "cancelled":
+		cancelled, statusReason = stamp, reason
+	}
+	_, err = tx.Exec(
+		"UPDATE CarPoolTrip SET TripStatus = ?, StartedDateTime = ?, CompletedDateTime = ?, CancelledDateTime = ?, StatusReason = ? WHERE TripID = ?",
+		to, started, completed, cancelled, statusReason, trip.TripID,
+	)
+
+	// The bookings of a cancelled trip are cancelled with it
+	var notifications []Notification
+	if err == nil && to == "cancelled" {
+		notifications, err = cancelTripBookings(tx, trip.TripID, destination, trip.StartDateTime, stamp.String, reason)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Return a response
+	trip.TripStatus = to
+	trip.StartedDateTime, trip.CompletedDateTime, trip.CancelledDateTime = nullableText(started), nullableText(completed), nullableText(cancelled)
+	trip.StatusReason = nullableText(statusReason)
+	trip.AllowedNextStates = tripTransitions[to]
+	notifyAll(notifications)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(trip)
+}
+
+// cancelTripBookings marks the active bookings of a trip as cancelled by the owner, and returns the notifications for their passengers.
+// The notifications are only sent once the transaction is committed.
+func cancelTripBookings(tx *sql.Tx, tripID int, destination, startDateTime, now string, reason sql.NullString) ([]Notification, error) {
+	rows, err := tx.Query(`
+		SELECT cb.BookingID, cu.UserID, cu.EmailAddress, cu.FirstName
+		FROM CarPoolBooking cb
+		JOIN CarPoolUser cu ON cb.PassengerID = cu.UserID
+		WHERE cb.TripID = ? AND cb.BookingStatus = ? FOR UPDATE`, tripID, bookingBooked)
+	if err != nil {
+		return nil, err
+	}
+	message := fmt.Sprintf("Your trip to %s on %s was cancelled by the car owner.", destination, startDateTime)
+	if reason.Valid {
+		message += "\n\nReason: " + reason.String
+	}
+	var notifications []Notification
+	for rows.Next() {
+		n := Notification{Event: "booking cancelled by owner", TripID: tripID, Subject: "Your trip to " + destination + " was cancelled", Message: message, Date: now}
+		if err := rows.Scan(&n.BookingID, &n.UserID, &n.EmailAddress, &n.FirstName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE CarPoolBooking SET BookingStatus = ?, CancelledDateTime = ?, CancellationReason = ? WHERE TripID = ? AND BookingStatus = ?",
+		bookingCancelledByOwner, now, reason, tripID, bookingBooked,
+	)
+	return notifications, err
+}
@@ -0,0 +1,150 @@
+// notifier.go
+
+package main
+
+// import the necessary packages
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Notification is a message to a user about one of their bookings
+type Notification struct {
+	Event        string `json:"Event"`
+	UserID       int    `json:"UserID"`
+	EmailAddress string `json:"EmailAddress"`
+	FirstName    string `json:"FirstName"`
+	TripID       int    `json:"TripID"`
+	BookingID    int    `json:"BookingID"`
+	Subject      string `json:"Subject"`
+	Message      string `json:"Message"`
+	Date         string `json:"Date"`
+}
+
+// Notifier delivers notifications to users
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// notifier is the transport used by the trip service, chosen with the NOTIFIER environment variable
+var notifier Notifier
+
+// LogNotifier prints notifications to stdout instead of delivering them, for development and offline testing
+type LogNotifier struct{}
+
+// Notify prints the notification
+func (LogNotifier) Notify(n Notification) error {
+	fmt.Printf("----- %s\nTo: %s (user %d)\nSubject: %s\n\n%s\n\n", n.Date, n.EmailAddress, n.UserID, n.Subject, n.Message)
+	return nil
+}
+
+// EmailNotifier emails notifications through an SMTP server
+type EmailNotifier struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// Notify sends the notification as a plain text email
+func (e EmailNotifier) Notify(n Notification) error {
+	// The subject carries text entered by car owners, so line breaks are removed to keep it a single header
+	// and anything beyond printable ASCII is sent as an encoded word
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(n.Subject)
+	message := "From: " + e.From + "\r\n" +
+		"To: " + n.EmailAddress + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll("Hi "+n.FirstName+",\n\n"+n.Message, "\n", "\r\n")
+	return smtp.SendMail(e.Addr, e.Auth, e.From, []string{n.EmailAddress}, []byte(message))
+}
+
+// WebhookNotifier posts notifications as JSON to a URL, signed with HMAC-SHA256 when a secret is set
+type WebhookNotifier struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+// Notify posts the notification and expects a 2xx response
+func (h WebhookNotifier) Notify(n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(h.Secret) > 0 {
+		mac := hmac.New(sha256.New, h.Secret)
+		mac.Write(body)
+		req.Header.Set("X-CarPool-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// loadNotifierConfig chooses the notification transport from the environment:
+// NOTIFIER=email uses SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM,
+// NOTIFIER=webhook posts to NOTIFY_WEBHOOK_URL signed with NOTIFY_WEBHOOK_SECRET, and anything else prints to stdout
+func loadNotifierConfig() {
+	switch os.Getenv("NOTIFIER") {
+	case "email":
+		host, port, from := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT"), os.Getenv("MAIL_FROM")
+		if host == "" || from == "" {
+			log.Fatal("NOTIFIER=email requires SMTP_HOST and MAIL_FROM")
+		}
+		if port == "" {
+			port = "587"
+		}
+		var auth smtp.Auth
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		notifier = EmailNotifier{Addr: host + ":" + port, Auth: auth, From: from}
+	case "webhook":
+		url := os.Getenv("NOTIFY_WEBHOOK_URL")
+		if url == "" {
+			log.Fatal("NOTIFIER=webhook requires NOTIFY_WEBHOOK_URL")
+		}
+		notifier = WebhookNotifier{URL: url, Secret: []byte(os.Getenv("NOTIFY_WEBHOOK_SECRET")), Client: &http.Client{Timeout: 10 * time.Second}}
+	default:
+		notifier = LogNotifier{}
+	}
+}
+
+// notifyAll delivers notifications in the background, so that a slow transport does not hold up the request
+func notifyAll(notifications []Notification) {
+	if len(notifications) == 0 {
+		return
+	}
+	go func() {
+		for _, n := range notifications {
+			if err := notifier.Notify(n); err != nil {
+				fmt.Println("notify:", n.Event, n.UserID, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+// overlap.go
+
+package main
+
+// import the necessary packages
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// tripBuffer is the free time required between two trips of the same owner, set with TRIP_BUFFER (none by default)
+var tripBuffer time.Duration
+
+// OverlapError represents a trip that clashes with other trips of its owner
+type OverlapError struct {
+	Message string `json:"Message"`
+	TripIDs []int  `json:"TripIDs"`
+}
+
+// loadOverlapConfig reads the buffer between trips from TRIP_BUFFER, such as "15m"
+func loadOverlapConfig() {
+	if value := os.Getenv("TRIP_BUFFER"); value != "" {
+		buffer, err := time.ParseDuration(value)
+		if err != nil || buffer < 0 {
+			log.Fatal("TRIP_BUFFER must be a duration such as 15m or 1h")
+		}
+		tripBuffer = buffer
+	}
+}
+
+// tripInterval returns when a trip starts and ends, the end is estimated from the duration when it is not given
+func tripInterval(startDateTime string, estimatedEnd sql.NullString, duration int) (time.Time, time.Time, error) {
+	start, err := parseTripTime(startDateTime)
+	if err != nil {
+		return start, start, errors.New("StartDateTime must be in the format YYYY-MM-DD HH:MM:SS")
+	}
+	end := start.Add(time.Duration(duration) * time.Minute)
+	if estimatedEnd.Valid && estimatedEnd.String != "" {
+		end, err = parseTripTime(estimatedEnd.String)
+		if err != nil {
+			return start, end, errors.New("EstimatedEndDateTime must be in the format YYYY-MM-DD HH:MM:SS")
+		}
+	}
+	if end.Before(start) {
+		return start, end, errors.New("EstimatedEndDateTime cannot be before StartDateTime")
+	}
+	return start, end, nil
+}
+
+// tripsOverlap reports whether two trips are closer than tripBuffer, trips that only touch are allowed when there is no buffer
+func tripsOverlap(start, end, otherStart, otherEnd time.Time) bool {
+	return start.Before(otherEnd.Add(tripBuffer)) && otherStart.Before(end.Add(tripBuffer))
+}
+
+// overlappingTrips returns the active trips of an owner that overlap the interval, including the buffer between trips.
+// The trip being edited is left out by passing its ID as excludeTripID.
+func overlappingTrips(tx *sql.Tx, ownerID, excludeTripID int, start, end time.Time) ([]int, error) {
+	rows, err := tx.Query(
+		"SELECT TripID, StartDateTime, EstimatedEndDateTime, TripDuration FROM CarPoolTrip WHERE UserID = ? AND TripID <> ? AND TripStatus IN ('created', 'fully booked', 'started')",
+		ownerID, excludeTripID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clashes := []int{}
+	for rows.Next() {
+		var tripID, duration int
+		var otherStartDateTime string
+		var otherEnd sql.NullString
+		if err := rows.Scan(&tripID, &otherStartDateTime, &otherEnd, &duration); err != nil {
+			return nil, err
+		}
+		otherStart, otherFinish, err := tripInterval(otherStartDateTime, otherEnd, duration)
+		if err != nil {
+			// Trips stored before the times were validated cannot block new ones
+			fmt.Println("overlap: trip", tripID, err)
+			continue
+		}
+		if tripsOverlap(start, end, otherStart, otherFinish) {
+			clashes = append(clashes, tripID)
+		}
+	}
+	return clashes, rows.Err()
+}
+
+// lockOwnerTrips serialises the publishing and editing of an owner's trips, so that two requests cannot both pass the overlap check
+func lockOwnerTrips(tx *sql.Tx, ownerID int) error {
+	var userID int
+	return tx.QueryRow("SELECT UserID FROM CarPoolUser WHERE UserID = ? FOR UPDATE", ownerID).Scan(&userID)
+}
+
+// writeOverlapError answers 409 Conflict with the trips that clash
+func writeOverlapError(w http.ResponseWriter, tripIDs []int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(OverlapError{Message: "The trip overlaps other trips of the car owner", TripIDs: tripIDs})
+}
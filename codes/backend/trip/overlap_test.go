@@ -0,0 +1,90 @@
+// overlap_test.go
+
+package main
+
+// import the necessary packages
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+// TestTripInterval checks the end of a trip, given or estimated from its duration, and the rejected times
+func TestTripInterval(t *testing.T) {
+	tests := []struct {
+		name      string
+		start     string
+		end       sql.NullString
+		duration  int
+		wantEnd   string
+		wantError bool
+	}{
+		{"end from duration", "2024-01-10 08:00:00", sql.NullString{}, 90, "2024-01-10 09:30:00", false},
+		{"empty end uses duration", "2024-01-10 08:00:00", sql.NullString{String: "", Valid: true}, 30, "2024-01-10 08:30:00", false},
+		{"given end wins over duration", "2024-01-10 08:00:00", sql.NullString{String: "2024-01-10 10:00:00", Valid: true}, 30, "2024-01-10 10:00:00", false},
+		{"end at start", "2024-01-10 08:00:00", sql.NullString{String: "2024-01-10 08:00:00", Valid: true}, 0, "2024-01-10 08:00:00", false},
+		{"end before start", "2024-01-10 08:00:00", sql.NullString{String: "2024-01-10 07:59:59", Valid: true}, 0, "", true},
+		{"malformed start", "2024-01-10T08:00:00", sql.NullString{}, 30, "", true},
+		{"malformed end", "2024-01-10 08:00:00", sql.NullString{String: "10:00", Valid: true}, 30, "", true},
+	}
+	for _, test := range tests {
+		start, end, err := tripInterval(test.start, test.end, test.duration)
+		if test.wantError {
+			if err == nil {
+				t.Errorf("%s: tripInterval accepted %q to %q", test.name, test.start, test.end.String)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: tripInterval: %v", test.name, err)
+			continue
+		}
+		if got := start.Format(dateTimeLayout); got != test.start {
+			t.Errorf("%s: start = %s, want %s", test.name, got, test.start)
+		}
+		if got := end.Format(dateTimeLayout); got != test.wantEnd {
+			t.Errorf("%s: end = %s, want %s", test.name, got, test.wantEnd)
+		}
+	}
+}
+
+// TestTripsOverlap checks the boundaries of two trips of the same owner, with and without TRIP_BUFFER
+func TestTripsOverlap(t *testing.T) {
+	defer func(buffer time.Duration) { tripBuffer = buffer }(tripBuffer)
+
+	at := func(value string) time.Time {
+		parsed, err := parseTripTime(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+
+	// The other trip runs from 10:00 to 11:00
+	otherStart, otherEnd := at("2024-01-10 10:00:00"), at("2024-01-10 11:00:00")
+	tests := []struct {
+		name       string
+		buffer     time.Duration
+		start, end string
+		want       bool
+	}{
+		{"before", 0, "2024-01-10 08:00:00", "2024-01-10 09:00:00", false},
+		{"ends when the other starts", 0, "2024-01-10 09:00:00", "2024-01-10 10:00:00", false},
+		{"ends a second into the other", 0, "2024-01-10 09:00:00", "2024-01-10 10:00:01", true},
+		{"inside", 0, "2024-01-10 10:15:00", "2024-01-10 10:45:00", true},
+		{"around", 0, "2024-01-10 09:00:00", "2024-01-10 12:00:00", true},
+		{"starts when the other ends", 0, "2024-01-10 11:00:00", "2024-01-10 12:00:00", false},
+		{"starts a second before the other ends", 0, "2024-01-10 10:59:59", "2024-01-10 12:00:00", true},
+		{"after", 0, "2024-01-10 12:00:00", "2024-01-10 13:00:00", false},
+		{"buffer after the other, exactly kept", 15 * time.Minute, "2024-01-10 11:15:00", "2024-01-10 12:00:00", false},
+		{"buffer after the other, too short", 15 * time.Minute, "2024-01-10 11:14:59", "2024-01-10 12:00:00", true},
+		{"buffer before the other, exactly kept", 15 * time.Minute, "2024-01-10 08:45:00", "2024-01-10 09:45:00", false},
+		{"buffer before the other, too short", 15 * time.Minute, "2024-01-10 08:45:01", "2024-01-10 09:45:01", true},
+	}
+	for _, test := range tests {
+		tripBuffer = test.buffer
+		if got := tripsOverlap(at(test.start), at(test.end), otherStart, otherEnd); got != test.want {
+			t.Errorf("%s: tripsOverlap = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// photo.go
+
+package main
+
+// import the necessary packages
+import (
+	"database/sql"
+	"os"
+	"strings"
+)
+
+// photoSizes are the thumbnails the user service keeps of every profile photo
+var photoSizes = []string{"small", "medium", "large"}
+
+// userServiceURL is the address at which clients reach the user service, which serves the profile photos
+var userServiceURL string
+
+// loadPhotoConfig reads the address of the user service from USER_SERVICE_URL
+func loadPhotoConfig() {
+	userServiceURL = strings.TrimRight(os.Getenv("USER_SERVICE_URL"), "/")
+	if userServiceURL == "" {
+		userServiceURL = "http://localhost:5000"
+	}
+}
+
+// photoURLs returns the address of each thumbnail of a profile photo, or nil when the user has no photo
+func photoURLs(photoID sql.NullString) map[string]string {
+	if !photoID.Valid {
+		return nil
+	}
+	urls := map[string]string{}
+	for _, size := range photoSizes {
+		urls[size] = userServiceURL + "/api/v1/photos/" + photoID.String + "/" + size
+	}
+	return urls
+}
@@ -0,0 +1,73 @@
+// roles.go
+
+package main
+
+// import the necessary packages
+import (
+	"net/http"
+)
+
+// Roles stored in CarPoolUser.UserType and carried by the access token
+const (
+	rolePassenger = "passenger"
+	roleCarOwner  = "car owner"
+	roleAdmin     = "admin"
+)
+
+// action is an operation of the trip service that a role may or may not perform
+type action string
+
+// Actions of the trip service
+const (
+	actionViewTrips       action = "view trips"
+	actionPublishTrip     action = "publish trip"
+	actionUpdateTrip      action = "update trip"
+	actionViewOwnedTrips  action = "view owned trips"
+	actionBookTrip        action = "book trip"
+	actionViewBookedTrips action = "view booked trips"
+	actionManageAnyTrip   action = "manage any trip"
+	actionAccessAnyUser   action = "access any user"
+)
+
+// rolePermissions maps each role to the actions it is allowed to perform
+var rolePermissions = map[string]map[action]bool{
+	rolePassenger: {
+		actionViewTrips:       true,
+		actionBookTrip:        true,
+		actionViewBookedTrips: true,
+	},
+	roleCarOwner: {
+		actionViewTrips:       true,
+		actionPublishTrip:     true,
+		actionUpdateTrip:      true,
+		actionViewOwnedTrips:  true,
+		actionBookTrip:        true,
+		actionViewBookedTrips: true,
+	},
+	roleAdmin: {
+		actionViewTrips:       true,
+		actionUpdateTrip:      true,
+		actionViewOwnedTrips:  true,
+		actionViewBookedTrips: true,
+		actionManageAnyTrip:   true,
+		actionAccessAnyUser:   true,
+	},
+}
+
+// can reports whether a role is allowed to perform an action
+func can(role string, a action) bool {
+	return rolePermissions[role][a]
+}
+
+// requireAction rejects requests whose caller's role is not allowed to perform the action
+func requireAction(a action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r)
+		if claims == nil || !can(claims.UserType, a) {
+			http.Error(w, "Your account type is not allowed to "+string(a), http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,131 @@
+// scheduler.go
+
+package main
+
+// import the necessary packages
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// defaultTripExpiryInterval is how often trips that were never started are expired, unless TRIP_EXPIRY_INTERVAL is set
+const defaultTripExpiryInterval = time.Minute
+
+// tripExpiryBatch is the most trips expired in one run, the rest are left for the next run
+const tripExpiryBatch = 500
+
+// job is a task that the trip service runs periodically in the background
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(now time.Time) error
+}
+
+// startScheduler runs each background job on its own interval
+func startScheduler() {
+	interval := defaultTripExpiryInterval
+	if value := os.Getenv("TRIP_EXPIRY_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("invalid TRIP_EXPIRY_INTERVAL %q", value)
+		}
+		interval = parsed
+	}
+
+	jobs := []job{
+		{name: "expire trips", interval: interval, run: expireStaleTrips},
+	}
+	for _, j := range jobs {
+		go func(j job) {
+			for {
+				runJob(j)
+				time.Sleep(j.interval)
+			}
+		}(j)
+	}
+}
+
+// runJob runs a job unless another replica of the trip service is already running it.
+// The MySQL named lock belongs to the connection, so it is released even if this replica dies mid-run.
+func runJob(j job) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		fmt.Println("scheduler:", j.name, err)
+		return
+	}
+	defer conn.Close()
+
+	lockName := "CAR_POOL." + j.name
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", lockName).Scan(&acquired); err != nil {
+		fmt.Println("scheduler:", j.name, err)
+		return
+	}
+	if acquired.Int64 != 1 {
+		return
+	}
+	defer func() {
+		if _, err := conn.ExecContext(ctx, "DO RELEASE_LOCK(?)", lockName); err != nil {
+			fmt.Println("scheduler:", j.name, err)
+		}
+	}()
+
+	if err := j.run(time.Now()); err != nil {
+		fmt.Println("scheduler:", j.name, err)
+	}
+}
+
+// expireStaleTrips moves the trips that were still open for booking at their start time to 'expired', with the reason.
+// Each trip is only expired if it is still open, so a trip started at the last moment, or expired by another run, is left alone.
+func expireStaleTrips(now time.Time) error {
+	// The cutoff and the expiry stamp are both in Singapore time, like the start times of trips
+	cutoff := now.In(tripLocation).Format(dateTimeLayout)
+	rows, err := db.Query(
+		"SELECT TripID, TripStatus FROM CarPoolTrip WHERE TripStatus IN ('created', 'fully booked') AND StartDateTime < ? ORDER BY StartDateTime LIMIT ?",
+		cutoff, tripExpiryBatch,
+	)
+	if err != nil {
+		return err
+	}
+	type staleTrip struct {
+		tripID int
+		status string
+	}
+	var stale []staleTrip
+	for rows.Next() {
+		var trip staleTrip
+		if err := rows.Scan(&trip.tripID, &trip.status); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, trip)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	expired := 0
+	for _, trip := range stale {
+		reason := fmt.Sprintf("Not started by its start time while %s", trip.status)
+		result, err := db.Exec(
+			"UPDATE CarPoolTrip SET TripStatus = 'expired', ExpiredDateTime = ?, StatusReason = ? WHERE TripID = ? AND TripStatus = ? AND StartDateTime < ?",
+			cutoff, reason, trip.tripID, trip.status, cutoff,
+		)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected > 0 {
+			expired++
+		}
+	}
+	if expired > 0 {
+		fmt.Println("scheduler: expired", expired, "trips")
+	}
+	return nil
+}
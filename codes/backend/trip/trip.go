@@ -6,13 +6,14 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
@@ -31,29 +32,70 @@ type Trip struct {
 	EstimatedEndDateTime sql.NullString `json:"EstimatedEndDateTime,omitempty"`
 	TripDuration         int            `json:"TripDuration"`
 	CompletedDateTime    sql.NullString `json:"CompletedDateTime,omitempty"`
+	VehicleID            *int           `json:"VehicleID"`
 }
 
 // Booking represents the booking of a passenger in a trip
 type Booking struct {
-	BookingID       int    `json:"BookingID"`
-	TripID          int    `json:"TripID"`
-	PassengerID     int    `json:"PassengerID"`
-	BookingDateTime string `json:"BookingDateTime"`
+	BookingID         int            `json:"BookingID"`
+	TripID            int            `json:"TripID"`
+	PassengerID       int            `json:"PassengerID"`
+	BookingDateTime   string         `json:"BookingDateTime"`
+	BookingStatus     string         `json:"BookingStatus"`
+	CancelledDateTime sql.NullString `json:"CancelledDateTime,omitempty"`
 }
 
 // TripWithDriverInfo represents a car-pooling trip with driver information
 type TripWithDriverInfo struct {
 	Trip
-	DriverFirstName string `json:"DriverFirstName"`
-	DriverLastName  string `json:"DriverLastName"`
-	DriverMobile    string `json:"DriverMobile"`
+	DriverFirstName string            `json:"DriverFirstName"`
+	DriverLastName  string            `json:"DriverLastName"`
+	DriverMobile    string            `json:"DriverMobile"`
+	DriverPhotoURLs map[string]string `json:"DriverPhotoURLs"`
+	Vehicle         *Vehicle          `json:"Vehicle"`
 }
 
+// dateTimeLayout is the format of the date and time columns in the database
+const dateTimeLayout = "2006-01-02 15:04:05"
+
 // db is the database connection pool
 var db *sql.DB
 
+// mysqlDuplicateEntry is the MySQL error number for a unique constraint violation
+const mysqlDuplicateEntry = 1062
+
+// isDuplicateEntry reports whether an error is a unique constraint violation
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+// tripLocation is the time zone of the start and end times of trips, which are entered in Singapore time
+var tripLocation = loadTripLocation()
+
+// loadTripLocation loads the Singapore time zone, falling back to its fixed offset when the zone database is missing
+func loadTripLocation() *time.Location {
+	location, err := time.LoadLocation("Asia/Singapore")
+	if err != nil {
+		return time.FixedZone("SGT", 8*60*60)
+	}
+	return location
+}
+
+// parseTripTime parses a trip date and time column, which is in Singapore time
+func parseTripTime(value string) (time.Time, error) {
+	return time.ParseInLocation(dateTimeLayout, value, tripLocation)
+}
+
 // main handles the connection to the database server and initializes the router for the API requests (entry point to the application)
 func main() {
+	// Load the token verification settings
+	loadTokenConfig()
+	loadPhotoConfig()
+	loadBookingConfig()
+	loadNotifierConfig()
+	loadOverlapConfig()
+
 	// Connect to the database server
 	var err error
 	db, err = sql.Open("mysql", "user:password@tcp(127.0.0.1:3306)/CAR_POOL")
@@ -62,23 +104,31 @@ func main() {
 	}
 	defer db.Close()
 
+	// Start expiring trips that were never started
+	startScheduler()
+
 	// Initialize the router
 	router := mux.NewRouter()
 
 	// Register the API endpoints with the router
-	router.HandleFunc("/api/v1/trips", publishNewTrip).Methods("POST")
-	router.HandleFunc("/api/v1/trips", getAvailableTrips).Methods("GET")
-	router.HandleFunc("/api/v1/passengerbookedtrips/{userID}", getPassengerBookedTrips).Methods("GET")
-	router.HandleFunc("/api/v1/carownerbookedtrips/{userID}", getCarOwnerBookedTrips).Methods("GET")
-	router.HandleFunc("/api/v1/startedtrips/{userID}", getStartedTrips).Methods("GET")
-	router.HandleFunc("/api/v1/completedtrips/{userID}", getCompletedTrips).Methods("GET")
-	router.HandleFunc("/api/v1/trips/{tripID}", updateTrip).Methods("PUT", "OPTIONS")
-	router.HandleFunc("/api/v1/bookings/{userID}/{tripID}", makeBooking).Methods("POST")
+	router.HandleFunc("/api/v1/trips", requireAuth(requireAction(actionPublishTrip, requireVerifiedEmail(publishNewTrip)))).Methods("POST")
+	router.HandleFunc("/api/v1/trips", requireAuth(requireAction(actionViewTrips, getAvailableTrips))).Methods("GET")
+	router.HandleFunc("/api/v1/passengerbookedtrips/{userID}", requireAuth(requireAction(actionViewBookedTrips, requireSelf(getPassengerBookedTrips)))).Methods("GET")
+	router.HandleFunc("/api/v1/carownerbookedtrips/{userID}", requireAuth(requireAction(actionViewOwnedTrips, requireSelf(getCarOwnerBookedTrips)))).Methods("GET")
+	router.HandleFunc("/api/v1/startedtrips/{userID}", requireAuth(requireAction(actionViewOwnedTrips, requireSelf(getStartedTrips)))).Methods("GET")
+	router.HandleFunc("/api/v1/completedtrips/{userID}", requireAuth(requireAction(actionViewBookedTrips, requireSelf(getCompletedTrips)))).Methods("GET")
+	router.HandleFunc("/api/v1/trips/{tripID}", requireAuth(requireAction(actionUpdateTrip, updateTrip))).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/v1/trips/{tripID}/start", requireAuth(requireAction(actionUpdateTrip, startTrip))).Methods("POST")
+	router.HandleFunc("/api/v1/trips/{tripID}/complete", requireAuth(requireAction(actionUpdateTrip, completeTrip))).Methods("POST")
+	router.HandleFunc("/api/v1/trips/{tripID}/cancel", requireAuth(requireAction(actionUpdateTrip, cancelTrip))).Methods("POST")
+	router.HandleFunc("/api/v1/bookings/{userID}/{tripID}", requireAuth(requireAction(actionBookTrip, requireSelf(requireVerifiedEmail(makeBooking))))).Methods("POST")
+	router.HandleFunc("/api/v1/bookings/{bookingID}", requireAuth(requireAction(actionBookTrip, cancelBooking))).Methods("DELETE")
 
 	// Create a new CORS handler
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
 		AllowCredentials: true,
 		Debug:            true,
 	})
@@ -102,11 +152,64 @@ func publishNewTrip(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Trips can only be published on behalf of the authenticated user
+	if strconv.Itoa(newTrip.UserID) != claimsFromContext(r).Subject {
+		http.Error(w, "You can only publish trips for your own account", http.StatusForbidden)
+		return
+	}
+
+	// The trip has to use one of the owner's vehicles, with no more seats than it can carry
+	if status, err := checkTripVehicle(newTrip.UserID, newTrip.VehicleID, newTrip.AvailableSeats, 0); err != nil {
+		http.Error(w, err.Error(), status)
+		fmt.Println(err)
+		return
+	}
+
+	// New trips are always open for booking, the dates of the lifecycle are set by the server
+	newTrip.TripStatus = "created"
+	newTrip.PublishDate = time.Now().Format(dateTimeLayout)
+	newTrip.CompletedDateTime = sql.NullString{}
+
+	start, end, err := tripInterval(newTrip.StartDateTime, newTrip.EstimatedEndDateTime, newTrip.TripDuration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The trip cannot overlap the owner's other active trips
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if err := lockOwnerTrips(tx, newTrip.UserID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	clashes, err := overlappingTrips(tx, newTrip.UserID, 0, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(clashes) > 0 {
+		writeOverlapError(w, clashes)
+		return
+	}
+
 	// Perform validation and store trip in the database
-	_, err = db.Exec(
-		"INSERT INTO CarPoolTrip (UserID, PickupAddress, AltPickupAddress, StartDateTime, DestinationAddress, AvailableSeats, TripStatus, PublishDate, EstimatedEndDateTime, TripDuration, CompletedDateTime) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
-		newTrip.UserID, newTrip.PickupAddress, newTrip.AltPickupAddress, newTrip.StartDateTime, newTrip.DestinationAddress, newTrip.AvailableSeats, newTrip.TripStatus, newTrip.PublishDate, newTrip.EstimatedEndDateTime, newTrip.TripDuration, newTrip.CompletedDateTime,
+	result, err := tx.Exec(
+		"INSERT INTO CarPoolTrip (UserID, PickupAddress, AltPickupAddress, StartDateTime, DestinationAddress, AvailableSeats, TripStatus, PublishDate, EstimatedEndDateTime, TripDuration, CompletedDateTime, VehicleID) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		newTrip.UserID, newTrip.PickupAddress, newTrip.AltPickupAddress, newTrip.StartDateTime, newTrip.DestinationAddress, newTrip.AvailableSeats, newTrip.TripStatus, newTrip.PublishDate, newTrip.EstimatedEndDateTime, newTrip.TripDuration, newTrip.CompletedDateTime, newTrip.VehicleID,
 	)
+	if err == nil {
+		var tripID int64
+		tripID, err = result.LastInsertId()
+		newTrip.TripID = int(tripID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		fmt.Println("2", err)
@@ -136,12 +239,116 @@ func updateTrip(w http.ResponseWriter, r *http.Request) {
 	// print out the updated trip
 	fmt.Println(updatedTrip)
 
+	// Lock the trip for the rest of the update, so that a concurrent start, cancel or booking is not overwritten
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Only the owner of the trip, or a moderator, may change it
+	var ownerID int
+	var vehicleID *int
+	var tripStatus, publishDate, startDateTime string
+	var completedDateTime, estimatedEnd sql.NullString
+	var duration int
+	err = tx.QueryRow(
+		"SELECT UserID, VehicleID, TripStatus, PublishDate, CompletedDateTime, StartDateTime, EstimatedEndDateTime, TripDuration FROM CarPoolTrip WHERE TripID = ? FOR UPDATE",
+		tripID,
+	).Scan(&ownerID, &vehicleID, &tripStatus, &publishDate, &completedDateTime, &startDateTime, &estimatedEnd, &duration)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		fmt.Println("3", err)
+		return
+	}
+	claims := claimsFromContext(r)
+	if strconv.Itoa(ownerID) != claims.Subject && !can(claims.UserType, actionManageAnyTrip) {
+		http.Error(w, "You can only update your own trips", http.StatusForbidden)
+		return
+	}
+
+	// The status only changes through the start, complete and cancel endpoints, and only open trips can be edited
+	if updatedTrip.TripStatus != "" && updatedTrip.TripStatus != tripStatus {
+		writeTransitionError(w, "Use the start, complete and cancel endpoints to change the status of a trip", tripStatus)
+		return
+	}
+	if tripStatus != "created" && tripStatus != "fully booked" {
+		writeTransitionError(w, "A "+tripStatus+" trip can no longer be edited", tripStatus)
+		return
+	}
+
+	// The owner and dates of a trip are not written by an update, they are only echoed back in the response
+	updatedTrip.UserID = ownerID
+	updatedTrip.PublishDate = publishDate
+	updatedTrip.CompletedDateTime = completedDateTime
+
+	// AvailableSeats are the seats still free, so the seats already booked count against the capacity of the vehicle
+	var booked int
+	err = tx.QueryRow("SELECT COUNT(*) FROM CarPoolBooking WHERE TripID = ? AND BookingStatus = ?", tripID, bookingBooked).Scan(&booked)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if updatedTrip.AvailableSeats < 0 || (booked == 0 && updatedTrip.AvailableSeats < 1) {
+		http.Error(w, "AvailableSeats must be at least 1, or 0 once the trip has bookings", http.StatusBadRequest)
+		return
+	}
+
+	// The status follows the seats left, a full trip reopens when seats are added and closes when none are left
+	updatedTrip.TripStatus = "created"
+	if updatedTrip.AvailableSeats == 0 {
+		updatedTrip.TripStatus = "fully booked"
+	}
+
+	// The vehicle is kept unless another one is given, trips published before vehicles were registered may have none
+	if updatedTrip.VehicleID == nil {
+		updatedTrip.VehicleID = vehicleID
+	}
+	if updatedTrip.VehicleID != nil {
+		if status, err := checkTripVehicle(ownerID, updatedTrip.VehicleID, updatedTrip.AvailableSeats, booked); err != nil {
+			http.Error(w, err.Error(), status)
+			fmt.Println(err)
+			return
+		}
+	}
+
+	// A trip whose times change cannot overlap the owner's other active trips
+	if updatedTrip.StartDateTime != startDateTime || updatedTrip.EstimatedEndDateTime != estimatedEnd || updatedTrip.TripDuration != duration {
+		start, end, err := tripInterval(updatedTrip.StartDateTime, updatedTrip.EstimatedEndDateTime, updatedTrip.TripDuration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := lockOwnerTrips(tx, ownerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tripIDInt, _ := strconv.Atoi(tripID)
+		clashes, err := overlappingTrips(tx, ownerID, tripIDInt, start, end)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(clashes) > 0 {
+			writeOverlapError(w, clashes)
+			return
+		}
+	}
+
 	// Perform validation and update trip in the database
-	_, err = db.Exec(
-		"UPDATE CarPoolTrip SET UserID=?, PickupAddress=?, AltPickupAddress=?, StartDateTime=?, DestinationAddress=?, AvailableSeats=?, TripStatus=?, PublishDate=?, EstimatedEndDateTime=?, TripDuration=?, CompletedDateTime=? WHERE TripID=?",
-		updatedTrip.UserID, updatedTrip.PickupAddress, updatedTrip.AltPickupAddress,
-		updatedTrip.StartDateTime, updatedTrip.DestinationAddress, updatedTrip.AvailableSeats, updatedTrip.TripStatus, updatedTrip.PublishDate, updatedTrip.EstimatedEndDateTime, updatedTrip.TripDuration, updatedTrip.CompletedDateTime, tripID,
+	_, err = tx.Exec(
+		"UPDATE CarPoolTrip SET PickupAddress=?, AltPickupAddress=?, StartDateTime=?, DestinationAddress=?, AvailableSeats=?, TripStatus=?, EstimatedEndDateTime=?, TripDuration=?, VehicleID=? WHERE TripID=?",
+		updatedTrip.PickupAddress, updatedTrip.AltPickupAddress,
+		updatedTrip.StartDateTime, updatedTrip.DestinationAddress, updatedTrip.AvailableSeats, updatedTrip.TripStatus, updatedTrip.EstimatedEndDateTime, updatedTrip.TripDuration, updatedTrip.VehicleID, tripID,
 	)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		fmt.Println("2", err)
@@ -163,18 +370,24 @@ func getAvailableTrips(w http.ResponseWriter, r *http.Request) {
         SELECT 
             ct.TripID, ct.UserID, ct.PickupAddress, ct.AltPickupAddress,
             ct.StartDateTime, ct.DestinationAddress, ct.AvailableSeats, ct.TripStatus, ct.PublishDate, ct.EstimatedEndDateTime, ct.TripDuration, ct.CompletedDateTime,
-            cu.FirstName AS DriverFirstName, cu.LastName AS DriverLastName, cu.MobileNumber AS DriverMobile
+            cu.FirstName AS DriverFirstName, cu.LastName AS DriverLastName, cu.MobileNumber AS DriverMobile, cu.PhotoID AS DriverPhotoID,
+            cv.VehicleID, cv.Make, cv.Model, cv.Colour, cv.CarPlateNumber, cv.PassengerCapacity
         FROM CarPoolTrip ct
         JOIN CarPoolUser cu ON ct.UserID = cu.UserID
-        WHERE ct.TripStatus = 'created' AND ct.AvailableSeats > 0`
+        LEFT JOIN CarPoolVehicle cv ON ct.VehicleID = cv.VehicleID
+        WHERE ct.TripStatus = 'created' AND ct.AvailableSeats > 0 AND ct.StartDateTime > ?`
+
+	// Trips that reached their start time are left out, even before the scheduler expires them
+	args := []interface{}{time.Now().In(tripLocation).Format(dateTimeLayout)}
 
 	// Add condition for the partial search on destination address
 	if destinationAddress != "" {
-		query += fmt.Sprintf(" AND ct.DestinationAddress LIKE '%%%s%%'", destinationAddress)
+		query += " AND ct.DestinationAddress LIKE ?"
+		args = append(args, "%"+destinationAddress+"%")
 	}
 
-	// Retrieve available trips with driver information from the database
-	rows, err := db.Query(query)
+	// Retrieve available trips with driver and vehicle information from the database
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		fmt.Println("1", err)
@@ -186,49 +399,37 @@ func getAvailableTrips(w http.ResponseWriter, r *http.Request) {
 	var trips []TripWithDriverInfo
 	for rows.Next() {
 		var tripWithDriverInfo TripWithDriverInfo
+		var vehicleID, capacity sql.NullInt64
+		var vehicleMake, model, colour, plate, driverPhotoID sql.NullString
 		err := rows.Scan(
 			&tripWithDriverInfo.TripID, &tripWithDriverInfo.UserID, &tripWithDriverInfo.PickupAddress, &tripWithDriverInfo.AltPickupAddress,
 			&tripWithDriverInfo.StartDateTime, &tripWithDriverInfo.DestinationAddress, &tripWithDriverInfo.AvailableSeats,
 			&tripWithDriverInfo.TripStatus, &tripWithDriverInfo.PublishDate,
 			&tripWithDriverInfo.EstimatedEndDateTime, &tripWithDriverInfo.TripDuration,
 			&tripWithDriverInfo.CompletedDateTime,
-			&tripWithDriverInfo.DriverFirstName, &tripWithDriverInfo.DriverLastName, &tripWithDriverInfo.DriverMobile,
+			&tripWithDriverInfo.DriverFirstName, &tripWithDriverInfo.DriverLastName, &tripWithDriverInfo.DriverMobile, &driverPhotoID,
+			&vehicleID, &vehicleMake, &model, &colour, &plate, &capacity,
 		)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			fmt.Println("2", err)
 			return
 		}
-
-		// Convert StartDateTime to time.Time
-		tripStartDateTime, err := time.Parse("2006-01-02 15:04:05", tripWithDriverInfo.StartDateTime)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			fmt.Println("3", err)
-			return
-		}
-
-		// Load the Singapore time zone
-		location, err := time.LoadLocation("Asia/Singapore")
-		if err != nil {
-			// Handle error
+		tripWithDriverInfo.DriverPhotoURLs = photoURLs(driverPhotoID)
+		if vehicleID.Valid {
+			tripWithDriverInfo.VehicleID = new(int)
+			*tripWithDriverInfo.VehicleID = int(vehicleID.Int64)
+			tripWithDriverInfo.Vehicle = &Vehicle{
+				VehicleID:         int(vehicleID.Int64),
+				Make:              vehicleMake.String,
+				Model:             model.String,
+				Colour:            colour.String,
+				CarPlateNumber:    plate.String,
+				PassengerCapacity: int(capacity.Int64),
+			}
 		}
 
-		// Convert the local trip start time to Singapore time
-		tripStartDateTimeSingapore := tripStartDateTime.In(location)
-
-		// Get the current time in Singapore time
-		nowSingapore := time.Now().In(location)
-
-		// Subtract 8 hours from the UTC time to get the time in Singapore time
-		tripStartDateTimeSingapore = tripStartDateTimeSingapore.Add(-8 * time.Hour)
-
-		// Check if StartDateTime is after the current time in Singapore time
-		if tripStartDateTimeSingapore.After(nowSingapore) {
-			trips = append(trips, tripWithDriverInfo)
-		} else {
-
-		}
+		trips = append(trips, tripWithDriverInfo)
 	}
 
 	// Return a response
@@ -245,10 +446,15 @@ func getPassengerBookedTrips(w http.ResponseWriter, r *http.Request) {
 	// Construct the SQL query
 	query := `
 		SELECT 
-			ct.*, cu.FirstName AS CarOwnerFirstName, cu.LastName AS CarOwnerLastName
+			ct.TripID, ct.UserID, ct.PickupAddress, ct.AltPickupAddress,
+			ct.StartDateTime, ct.DestinationAddress, ct.AvailableSeats, ct.TripStatus, ct.PublishDate,
+			ct.EstimatedEndDateTime, ct.TripDuration, ct.CompletedDateTime,
+			cu.FirstName AS CarOwnerFirstName, cu.LastName AS CarOwnerLastName,
+			cb.BookingID, cb.BookingStatus, cb.CancelledDateTime, cb.CancellationReason
 		FROM CarPoolTrip ct
+		JOIN CarPoolBooking cb ON ct.TripID = cb.TripID
 		JOIN CarPoolUser cu ON ct.UserID = cu.UserID
-		WHERE ct.TripID IN (SELECT TripID FROM CarPoolBooking WHERE PassengerID = ?)`
+		WHERE cb.PassengerID = ?`
 
 	// Retrieve booked trips for a specific passenger from the database
 	rows, err := db.Query(query, userID)
@@ -276,6 +482,10 @@ func getPassengerBookedTrips(w http.ResponseWriter, r *http.Request) {
 		CompletedDateTime    sql.NullString `json:"CompletedDateTime"`
 		CarOwnerFirstName    string         `json:"CarOwnerFirstName"`
 		CarOwnerLastName     string         `json:"CarOwnerLastName"`
+		BookingID            int            `json:"BookingID"`
+		BookingStatus        string         `json:"BookingStatus"`
+		CancelledDateTime    sql.NullString `json:"CancelledDateTime"`
+		CancellationReason   sql.NullString `json:"CancellationReason"`
 	}
 	var trips []TripWithCarOwner
 
@@ -287,6 +497,7 @@ func getPassengerBookedTrips(w http.ResponseWriter, r *http.Request) {
 			&trip.StartDateTime, &trip.DestinationAddress, &trip.AvailableSeats, &trip.TripStatus, &trip.PublishDate,
 			&trip.EstimatedEndDateTime, &trip.TripDuration, &trip.CompletedDateTime,
 			&trip.CarOwnerFirstName, &trip.CarOwnerLastName,
+			&trip.BookingID, &trip.BookingStatus, &trip.CancelledDateTime, &trip.CancellationReason,
 		)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -314,7 +525,8 @@ func getCarOwnerBookedTrips(w http.ResponseWriter, r *http.Request) {
 		ct.TripID, ct.UserID, ct.PickupAddress, ct.AltPickupAddress,
 		ct.StartDateTime, ct.DestinationAddress, ct.AvailableSeats, ct.TripStatus, ct.PublishDate,
 		ct.EstimatedEndDateTime, ct.TripDuration, ct.CompletedDateTime,
-		cu.UserID AS PassengerID, cu.FirstName AS PassengerFirstName, cu.LastName AS PassengerLastName, cu.MobileNumber AS PassengerMobileNumber
+		cu.UserID AS PassengerID, cu.FirstName AS PassengerFirstName, cu.LastName AS PassengerLastName, cu.MobileNumber AS PassengerMobileNumber,
+		cb.BookingID, cb.BookingStatus, cb.CancelledDateTime
 	FROM CarPoolTrip ct
 	JOIN CarPoolBooking cb ON ct.TripID = cb.TripID
 	JOIN CarPoolUser cu ON cb.PassengerID = cu.UserID
@@ -327,12 +539,15 @@ func getCarOwnerBookedTrips(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
-	// Passenger represents passenger information
+	// Passenger represents passenger information, with the booking so that cancellations can be shown
 	type Passenger struct {
-		PassengerID           int    `json:"PassengerID"`
-		PassengerFirstName    string `json:"PassengerFirstName"`
-		PassengerLastName     string `json:"PassengerLastName"`
-		PassengerMobileNumber string `json:"PassengerMobileNumber"`
+		PassengerID           int            `json:"PassengerID"`
+		PassengerFirstName    string         `json:"PassengerFirstName"`
+		PassengerLastName     string         `json:"PassengerLastName"`
+		PassengerMobileNumber string         `json:"PassengerMobileNumber"`
+		BookingID             int            `json:"BookingID"`
+		BookingStatus         string         `json:"BookingStatus"`
+		CancelledDateTime     sql.NullString `json:"CancelledDateTime"`
 	}
 
 	// TripWithPassenger represents trip details with passenger information
@@ -362,6 +577,7 @@ func getCarOwnerBookedTrips(w http.ResponseWriter, r *http.Request) {
 			&tripID, &trip.UserID, &trip.PickupAddress, &trip.AltPickupAddress,
 			&trip.StartDateTime, &trip.DestinationAddress, &trip.AvailableSeats, &trip.TripStatus, &trip.PublishDate, &trip.EstimatedEndDateTime, &trip.TripDuration, &trip.CompletedDateTime,
 			&passenger.PassengerID, &passenger.PassengerFirstName, &passenger.PassengerLastName, &passenger.PassengerMobileNumber,
+			&passenger.BookingID, &passenger.BookingStatus, &passenger.CancelledDateTime,
 		)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -400,7 +616,11 @@ func getStartedTrips(w http.ResponseWriter, r *http.Request) {
 	userID := params["userID"]
 
 	// Retrieve started trips for a specific user from the database
-	rows, err := db.Query("SELECT * FROM CarPoolTrip WHERE TripStatus = 'started' AND UserID = ?", userID)
+	rows, err := db.Query(`
+	SELECT
+		TripID, UserID, PickupAddress, AltPickupAddress, StartDateTime, DestinationAddress, AvailableSeats,
+		TripStatus, PublishDate, EstimatedEndDateTime, TripDuration, CompletedDateTime, VehicleID
+	FROM CarPoolTrip WHERE TripStatus = 'started' AND UserID = ?`, userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -414,7 +634,7 @@ func getStartedTrips(w http.ResponseWriter, r *http.Request) {
 		err := rows.Scan(
 			&trip.TripID, &trip.UserID, &trip.PickupAddress, &trip.AltPickupAddress,
 			&trip.StartDateTime, &trip.DestinationAddress, &trip.AvailableSeats, &trip.TripStatus, &trip.PublishDate,
-			&trip.EstimatedEndDateTime, &trip.TripDuration, &trip.CompletedDateTime,
+			&trip.EstimatedEndDateTime, &trip.TripDuration, &trip.CompletedDateTime, &trip.VehicleID,
 		)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -437,11 +657,14 @@ func getCompletedTrips(w http.ResponseWriter, r *http.Request) {
 	// Retrieve completed trips for a specific user from the database
 	rows, err := db.Query(`
 	SELECT 
-		ct.*, cu.FirstName AS DriverFirstName, cu.LastName AS DriverLastName, cb.PassengerID AS PassengerID
+		ct.TripID, ct.UserID, ct.PickupAddress, ct.AltPickupAddress,
+		ct.StartDateTime, ct.DestinationAddress, ct.AvailableSeats, ct.TripStatus, ct.PublishDate,
+		ct.EstimatedEndDateTime, ct.TripDuration, ct.CompletedDateTime,
+		cu.FirstName AS DriverFirstName, cu.LastName AS DriverLastName, cb.PassengerID AS PassengerID
 	FROM CarPoolTrip ct
 	JOIN CarPoolBooking cb ON ct.TripID = cb.TripID
 	JOIN CarPoolUser cu ON ct.UserID = cu.UserID
-	WHERE ct.TripStatus = 'completed' AND cb.PassengerID = ?
+	WHERE ct.TripStatus = 'completed' AND cb.PassengerID = ? AND cb.BookingStatus = 'booked'
 	ORDER BY ct.CompletedDateTime DESC`, userID)
 
 	if err != nil {
@@ -510,18 +733,123 @@ func makeBooking(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Lock the trip until the booking is stored, so that two passengers cannot take the same seat
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID, availableSeats int
+	var tripStatus, startDateTime string
+	err = tx.QueryRow("SELECT UserID, TripStatus, StartDateTime, AvailableSeats FROM CarPoolTrip WHERE TripID = ? FOR UPDATE", tripIDInt).Scan(&ownerID, &tripStatus, &startDateTime, &availableSeats)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Trip not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Car owners cannot book their own trips
+	if ownerID == userIDInt {
+		http.Error(w, "You cannot book your own trip", http.StatusForbidden)
+		return
+	}
+
+	// Deleted accounts cannot book, even with a token issued before the deletion
+	var deletionDate sql.NullString
+	err = tx.QueryRow("SELECT DeletionDate FROM CarPoolUser WHERE UserID = ? LOCK IN SHARE MODE", userIDInt).Scan(&deletionDate)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || deletionDate.Valid {
+		http.Error(w, "Deleted accounts cannot book trips", http.StatusForbidden)
+		return
+	}
+
+	// A passenger can only book a trip once, a cancelled booking is booked again instead
+	var previousID int
+	var previousStatus string
+	err = tx.QueryRow("SELECT BookingID, BookingStatus FROM CarPoolBooking WHERE TripID = ? AND PassengerID = ? FOR UPDATE", tripIDInt, userIDInt).Scan(&previousID, &previousStatus)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil && previousStatus == bookingBooked {
+		http.Error(w, "You have already booked this trip", http.StatusConflict)
+		return
+	}
+	rebooking := err == nil
+
+	// Only trips that are open and have not started yet can be booked
+	if tripStatus == "fully booked" || (tripStatus == "created" && availableSeats < 1) {
+		http.Error(w, "Trip is fully booked", http.StatusConflict)
+		return
+	}
+	if tripStatus != "created" {
+		http.Error(w, "Trip is no longer open for booking", http.StatusConflict)
+		return
+	}
+	tripStart, err := parseTripTime(startDateTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !tripStart.After(time.Now()) {
+		http.Error(w, "Trip has already started", http.StatusConflict)
+		return
+	}
+
 	// Create a new booking record with the current date and time
 	booking := Booking{
 		TripID:          tripIDInt,
 		PassengerID:     userIDInt,
-		BookingDateTime: time.Now().Format("2006-01-02 15:04:05"),
+		BookingDateTime: time.Now().Format(dateTimeLayout),
+		BookingStatus:   bookingBooked,
 	}
 
-	// Perform validation and store the booking in the database
-	_, err = db.Exec(
-		"INSERT INTO CarPoolBooking (TripID, PassengerID, BookingDateTime) VALUES (?, ?, ?)",
-		booking.TripID, booking.PassengerID, booking.BookingDateTime,
-	)
+	// Store the booking and take the seat, the last seat closes the trip for booking
+	if rebooking {
+		booking.BookingID = previousID
+		_, err = tx.Exec(
+			"UPDATE CarPoolBooking SET BookingDateTime = ?, BookingStatus = ?, CancelledDateTime = NULL WHERE BookingID = ?",
+			booking.BookingDateTime, booking.BookingStatus, booking.BookingID,
+		)
+	} else {
+		var result sql.Result
+		result, err = tx.Exec(
+			"INSERT INTO CarPoolBooking (TripID, PassengerID, BookingDateTime, BookingStatus) VALUES (?, ?, ?, ?)",
+			booking.TripID, booking.PassengerID, booking.BookingDateTime, booking.BookingStatus,
+		)
+		if err == nil {
+			var bookingID int64
+			bookingID, err = result.LastInsertId()
+			booking.BookingID = int(bookingID)
+		}
+	}
+	if isDuplicateEntry(err) {
+		http.Error(w, "You have already booked this trip", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The trip row is locked, so the seats and status are computed from the values read above
+	seatsLeft := availableSeats - 1
+	status := tripStatus
+	if seatsLeft == 0 {
+		status = "fully booked"
+	}
+	_, err = tx.Exec("UPDATE CarPoolTrip SET AvailableSeats = ?, TripStatus = ? WHERE TripID = ?", seatsLeft, status, tripIDInt)
+	if err == nil {
+		err = tx.Commit()
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -0,0 +1,53 @@
+// vehicle.go
+
+package main
+
+// import the necessary packages
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Vehicle represents the car registered by a car owner for a trip, so that passengers can recognise it
+type Vehicle struct {
+	VehicleID         int    `json:"VehicleID"`
+	Make              string `json:"Make"`
+	Model             string `json:"Model"`
+	Colour            string `json:"Colour"`
+	CarPlateNumber    string `json:"CarPlateNumber"`
+	PassengerCapacity int    `json:"PassengerCapacity"`
+}
+
+// checkTripVehicle checks that the vehicle is registered to the owner of the trip and can carry the seats offered
+// on top of the seats already booked. A trip with bookings may offer no more seats, it is then fully booked.
+// It returns the HTTP status to answer with when the trip cannot use the vehicle.
+func checkTripVehicle(ownerID int, vehicleID *int, seats, booked int) (int, error) {
+	if vehicleID == nil {
+		return http.StatusBadRequest, errors.New("VehicleID is required")
+	}
+
+	var capacity int
+	err := db.QueryRow("SELECT PassengerCapacity FROM CarPoolVehicle WHERE VehicleID = ? AND UserID = ? AND RetiredDate IS NULL", *vehicleID, ownerID).Scan(&capacity)
+	if err == sql.ErrNoRows {
+		return http.StatusBadRequest, errors.New("VehicleID is not one of the registered vehicles of the trip owner")
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if booked == 0 && seats < 1 {
+		return http.StatusBadRequest, errors.New("AvailableSeats must be at least 1")
+	}
+	if seats < 0 {
+		return http.StatusBadRequest, errors.New("AvailableSeats cannot be negative")
+	}
+	if seats+booked > capacity {
+		if booked > 0 {
+			return http.StatusBadRequest, fmt.Errorf("AvailableSeats cannot exceed %d, the vehicle's capacity of %d passengers less the %d seats already booked", capacity-booked, capacity, booked)
+		}
+		return http.StatusBadRequest, fmt.Errorf("AvailableSeats cannot exceed the vehicle's capacity of %d passengers", capacity)
+	}
+	return http.StatusOK, nil
+}
@@ -0,0 +1,421 @@
+// admin.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// bootstrapAdmin creates the first admin account from ADMIN_EMAIL, ADMIN_MOBILE and ADMIN_PASSWORD,
+// unless an account with that email address already exists. The password is only ever stored hashed.
+func bootstrapAdmin() {
+	email := normalizeEmail(os.Getenv("ADMIN_EMAIL"))
+	mobile := normalizeMobileNumber(os.Getenv("ADMIN_MOBILE"))
+	password := os.Getenv("ADMIN_PASSWORD")
+	if email == "" && mobile == "" && password == "" {
+		return
+	}
+
+	// The account follows the same rules as a registration
+	admin := User{FirstName: "Admin", LastName: "Admin", EmailAddress: email, MobileNumber: mobile, UserType: roleAdmin}
+	errs := validateProfile(admin)
+	if reason := validatePassword(password); reason != "" {
+		errs["UserPassword"] = reason
+	}
+	if len(errs) > 0 {
+		log.Fatalf("invalid bootstrap admin, check ADMIN_EMAIL, ADMIN_MOBILE and ADMIN_PASSWORD: %v", errs)
+	}
+
+	var existing int
+	if err := db.QueryRow("SELECT COUNT(*) FROM CarPoolUser WHERE EmailAddress = ?", email).Scan(&existing); err != nil {
+		log.Fatal(err)
+	}
+	if existing > 0 {
+		return
+	}
+
+	hashed, err := hashPassword(password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now().Format(dateTimeLayout)
+	_, err = db.Exec(
+		"INSERT INTO CarPoolUser (FirstName, LastName, MobileNumber, EmailAddress, UserPassword, CreationDate, LastUpdate, UserType, EmailVerifiedDate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		admin.FirstName, admin.LastName, admin.MobileNumber, admin.EmailAddress, hashed, now, now, admin.UserType, now,
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Created the bootstrap admin account", email)
+}
+
+// Page size of the user directory
+const (
+	directoryDefaultLimit = 20
+	directoryMaxLimit     = 100
+)
+
+// directorySortColumns are the columns the user directory can be sorted by
+var directorySortColumns = map[string]bool{
+	"UserID":       true,
+	"CreationDate": true,
+	"LastUpdate":   true,
+	"FirstName":    true,
+	"LastName":     true,
+	"EmailAddress": true,
+}
+
+// Status filters of the user directory
+var directoryStatusFilters = map[string]string{
+	"active":    "DeletionDate IS NULL AND SuspendedDate IS NULL",
+	"suspended": "DeletionDate IS NULL AND SuspendedDate IS NOT NULL",
+	"deleted":   "DeletionDate IS NOT NULL",
+}
+
+// maxSuspensionReason is the longest suspension or reinstatement reason that is stored
+const maxSuspensionReason = 255
+
+// AdminUserResponse represents a user as listed in the admin directory
+type AdminUserResponse struct {
+	UserResponse
+	SuspendedDate    *string `json:"SuspendedDate"`
+	SuspensionReason *string `json:"SuspensionReason"`
+}
+
+// directoryCursor marks the last user of a page, it is handed to the client as an opaque string
+type directoryCursor struct {
+	Value  string `json:"v"`
+	UserID int    `json:"id"`
+}
+
+// newAdminUserResponse converts the database model of a user into its directory entry
+func newAdminUserResponse(user User) AdminUserResponse {
+	return AdminUserResponse{
+		UserResponse:     newUserResponse(user),
+		SuspendedDate:    fromNullString(user.SuspendedDate),
+		SuspensionReason: fromNullString(user.SuspensionReason),
+	}
+}
+
+// sortValue returns the value of a sort column of a user, as compared by the database
+func sortValue(user User, column string) string {
+	switch column {
+	case "CreationDate":
+		return user.CreationDate
+	case "LastUpdate":
+		return user.LastUpdate
+	case "FirstName":
+		return user.FirstName
+	case "LastName":
+		return user.LastName
+	case "EmailAddress":
+		return user.EmailAddress
+	}
+	return strconv.Itoa(user.UserID)
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+// listUsers returns a page of the user directory for admins.
+// Filters: UserType, status (active, suspended or deleted), createdFrom and createdTo (YYYY-MM-DD, inclusive)
+// and q (part of the name, email address or mobile number). Sorting: sort and order (asc or desc).
+// Pagination: limit, and cursor with the NextCursor of the previous page.
+func listUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	conditions := []string{}
+	args := []interface{}{}
+
+	// Apply the filters
+	if userType := query.Get("UserType"); userType != "" {
+		if _, found := rolePermissions[userType]; !found {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Unknown UserType " + userType})
+			return
+		}
+		conditions = append(conditions, "UserType = ?")
+		args = append(args, userType)
+	}
+	if status := query.Get("status"); status != "" {
+		condition, found := directoryStatusFilters[status]
+		if !found {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "status must be active, suspended or deleted"})
+			return
+		}
+		conditions = append(conditions, condition)
+	}
+	if value := query.Get("createdFrom"); value != "" {
+		from, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "createdFrom must be a date in the format YYYY-MM-DD"})
+			return
+		}
+		conditions = append(conditions, "CreationDate >= ?")
+		args = append(args, from.Format(dateTimeLayout))
+	}
+	if value := query.Get("createdTo"); value != "" {
+		to, err := time.ParseInLocation("2006-01-02", value, time.Local)
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "createdTo must be a date in the format YYYY-MM-DD"})
+			return
+		}
+		conditions = append(conditions, "CreationDate < ?")
+		args = append(args, to.AddDate(0, 0, 1).Format(dateTimeLayout))
+	}
+	if q := strings.TrimSpace(query.Get("q")); q != "" {
+		pattern := "%" + escapeLike(q) + "%"
+		conditions = append(conditions, "(CONCAT(FirstName, ' ', LastName) LIKE ? OR EmailAddress LIKE ? OR MobileNumber LIKE ?)")
+		args = append(args, pattern, pattern, pattern)
+	}
+
+	// Sort by the chosen column, with the user ID breaking ties so that the order is stable across pages
+	column := query.Get("sort")
+	if column == "" {
+		column = "UserID"
+	}
+	if !directorySortColumns[column] {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "sort must be one of UserID, CreationDate, LastUpdate, FirstName, LastName or EmailAddress"})
+		return
+	}
+	order := strings.ToLower(query.Get("order"))
+	if order == "" {
+		order = "asc"
+	}
+	if order != "asc" && order != "desc" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "order must be asc or desc"})
+		return
+	}
+	comparison := ">"
+	if order == "desc" {
+		comparison = "<"
+	}
+
+	limit := directoryDefaultLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > directoryMaxLimit {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": fmt.Sprintf("limit must be between 1 and %d", directoryMaxLimit)})
+			return
+		}
+		limit = parsed
+	}
+
+	// Continue after the last user of the previous page
+	if value := query.Get("cursor"); value != "" {
+		var cursor directoryCursor
+		raw, err := base64.RawURLEncoding.DecodeString(value)
+		if err == nil {
+			err = json.Unmarshal(raw, &cursor)
+		}
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid cursor"})
+			return
+		}
+		if column == "UserID" {
+			conditions = append(conditions, "UserID "+comparison+" ?")
+			args = append(args, cursor.UserID)
+		} else {
+			conditions = append(conditions, "("+column+" "+comparison+" ? OR ("+column+" = ? AND UserID "+comparison+" ?))")
+			args = append(args, cursor.Value, cursor.Value, cursor.UserID)
+		}
+	}
+
+	statement := "SELECT " + userColumns + " FROM CarPoolUser"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY "
+	if column != "UserID" {
+		statement += column + " " + order + ", "
+	}
+	statement += "UserID " + order + " LIMIT ?"
+	args = append(args, limit+1)
+
+	rows, err := db.Query(statement, args...)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	// Add the data into the struct, one user more than the page tells whether there is a next page
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		users = append(users, user)
+	}
+
+	var nextCursor *string
+	if len(users) > limit {
+		users = users[:limit]
+		last := users[limit-1]
+		raw, _ := json.Marshal(directoryCursor{Value: sortValue(last, column), UserID: last.UserID})
+		encoded := base64.RawURLEncoding.EncodeToString(raw)
+		nextCursor = &encoded
+	}
+
+	page := make([]AdminUserResponse, 0, len(users))
+	for _, user := range users {
+		page = append(page, newAdminUserResponse(user))
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Users": page, "NextCursor": nextCursor})
+}
+
+// decodeReason reads the mandatory reason of a suspension or reinstatement
+func decodeReason(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Reason string `json:"Reason"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	body.Reason = strings.TrimSpace(body.Reason)
+	if err != nil || body.Reason == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Reason is required"})
+		return "", false
+	}
+	if len(body.Reason) > maxSuspensionReason {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": fmt.Sprintf("Reason must be at most %d characters", maxSuspensionReason)})
+		return "", false
+	}
+	return body.Reason, true
+}
+
+// suspendUser blocks an account from logging in and logs it out everywhere, until an admin reinstates it
+func suspendUser(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	if claimsFromContext(r).Subject == userID {
+		jsonResponse(w, http.StatusForbidden, map[string]interface{}{"Message": "You cannot suspend your own account"})
+		return
+	}
+	reason, ok := decodeReason(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM CarPoolUser WHERE UserID = ? AND DeletionDate IS NULL FOR UPDATE", userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if user.SuspendedDate.Valid {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Account is already suspended"})
+		return
+	}
+
+	// Suspend the account and record why
+	now := time.Now().Format(dateTimeLayout)
+	_, err = tx.Exec("UPDATE CarPoolUser SET SuspendedDate = ?, SuspensionReason = ?, LastUpdate = ? WHERE UserID = ?", now, reason, now, user.UserID)
+	if err == nil {
+		err = recordHistory(tx, r, user.UserID, historyAccountSuspended, []FieldChange{
+			{"SuspendedDate", sql.NullString{}, textValue(now)},
+			{"SuspensionReason", sql.NullString{}, textValue(reason)},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Log the account out everywhere
+	if _, err := revokeAllSessions(user.UserID); err != nil {
+		fmt.Println(err)
+	}
+
+	user.SuspendedDate, user.SuspensionReason, user.LastUpdate = textValue(now), textValue(reason), now
+	jsonResponse(w, http.StatusOK, newAdminUserResponse(user))
+}
+
+// reinstateUser lifts the suspension of an account
+func reinstateUser(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	reason, ok := decodeReason(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM CarPoolUser WHERE UserID = ? AND DeletionDate IS NULL FOR UPDATE", userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if !user.SuspendedDate.Valid {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Account is not suspended"})
+		return
+	}
+
+	// Lift the suspension and record why
+	now := time.Now().Format(dateTimeLayout)
+	_, err = tx.Exec("UPDATE CarPoolUser SET SuspendedDate = NULL, SuspensionReason = NULL, LastUpdate = ? WHERE UserID = ?", now, user.UserID)
+	if err == nil {
+		err = recordHistory(tx, r, user.UserID, historyAccountReinstated, []FieldChange{
+			{"SuspendedDate", user.SuspendedDate, sql.NullString{}},
+			{"SuspensionReason", user.SuspensionReason, sql.NullString{}},
+			{"ReinstatementReason", sql.NullString{}, textValue(reason)},
+		})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	user.SuspendedDate, user.SuspensionReason, user.LastUpdate = sql.NullString{}, sql.NullString{}, now
+	jsonResponse(w, http.StatusOK, newAdminUserResponse(user))
+}
@@ -0,0 +1,75 @@
+// auth.go
+
+package main
+
+// import all the necessary packages
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// contextKey is the type of the keys stored in the request context by the middleware
+type contextKey string
+
+// claimsContextKey stores the verified token claims of the caller
+const claimsContextKey contextKey = "claims"
+
+// requireAuth rejects requests that do not carry a valid bearer access token
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract the token from the Authorization header
+		tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || tokenString == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Missing access token"})
+			return
+		}
+
+		// Verify the token and keep its claims for the handlers
+		claims, err := parseAccessToken(tokenString)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid or expired access token"})
+			return
+		}
+
+		// Reject tokens of sessions that were logged out or revoked
+		active, err := sessionActive(claims)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		if !active {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Session has been revoked"})
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)))
+	}
+}
+
+// requireSelf rejects requests whose {userID} path variable does not match the subject of the access token,
+// unless the caller is a moderator allowed to access any user
+func requireSelf(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r)
+		if claims == nil || (mux.Vars(r)["userID"] != claims.Subject && !can(claims.UserType, actionAccessAnyUser)) {
+			jsonResponse(w, http.StatusForbidden, map[string]interface{}{"Message": "You are not allowed to access this user"})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// claimsFromContext returns the token claims stored by requireAuth, or nil if the request is unauthenticated
+func claimsFromContext(r *http.Request) *TokenClaims {
+	claims, _ := r.Context().Value(claimsContextKey).(*TokenClaims)
+	return claims
+}
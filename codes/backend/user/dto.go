@@ -0,0 +1,141 @@
+// dto.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+)
+
+// RegisterUserRequest represents the body of a registration
+type RegisterUserRequest struct {
+	FirstName      string  `json:"FirstName"`
+	LastName       string  `json:"LastName"`
+	MobileNumber   string  `json:"MobileNumber"`
+	EmailAddress   string  `json:"EmailAddress"`
+	UserPassword   string  `json:"UserPassword"`
+	DriverLicense  *string `json:"DriverLicense"`
+	CarPlateNumber *string `json:"CarPlateNumber"`
+	UserType       string  `json:"UserType"`
+}
+
+// UpdateUserRequest represents the body of a full profile update, the password has its own endpoint
+type UpdateUserRequest struct {
+	FirstName      string  `json:"FirstName"`
+	LastName       string  `json:"LastName"`
+	MobileNumber   string  `json:"MobileNumber"`
+	EmailAddress   string  `json:"EmailAddress"`
+	DriverLicense  *string `json:"DriverLicense"`
+	CarPlateNumber *string `json:"CarPlateNumber"`
+	UserType       string  `json:"UserType"`
+}
+
+// UserResponse represents a user as returned to the client, it never contains the password
+type UserResponse struct {
+	UserID         int               `json:"UserID"`
+	FirstName      string            `json:"FirstName"`
+	LastName       string            `json:"LastName"`
+	MobileNumber   string            `json:"MobileNumber"`
+	EmailAddress   string            `json:"EmailAddress"`
+	DriverLicense  *string           `json:"DriverLicense"`
+	CarPlateNumber *string           `json:"CarPlateNumber"`
+	CreationDate   string            `json:"CreationDate"`
+	LastUpdate     string            `json:"LastUpdate"`
+	DeletionDate   *string           `json:"DeletionDate"`
+	UserType       string            `json:"UserType"`
+	EmailVerified  bool              `json:"EmailVerified"`
+	PhotoURLs      map[string]string `json:"PhotoURLs"`
+}
+
+// OwnerApplicationResponse represents a car owner application as returned to the client
+type OwnerApplicationResponse struct {
+	ApplicationID  int     `json:"ApplicationID"`
+	UserID         int     `json:"UserID"`
+	DriverLicense  string  `json:"DriverLicense"`
+	CarPlateNumber string  `json:"CarPlateNumber"`
+	Status         string  `json:"Status"`
+	SubmissionDate string  `json:"SubmissionDate"`
+	ReviewDate     *string `json:"ReviewDate"`
+	ReviewerID     *int64  `json:"ReviewerID"`
+	ReviewNote     *string `json:"ReviewNote"`
+}
+
+// toUser converts a registration into the database model
+func (req RegisterUserRequest) toUser() User {
+	return User{
+		FirstName:      req.FirstName,
+		LastName:       req.LastName,
+		MobileNumber:   req.MobileNumber,
+		EmailAddress:   req.EmailAddress,
+		UserPassword:   req.UserPassword,
+		DriverLicense:  toNullString(req.DriverLicense),
+		CarPlateNumber: toNullString(req.CarPlateNumber),
+		UserType:       req.UserType,
+	}
+}
+
+// toUser converts a profile update into the database model
+func (req UpdateUserRequest) toUser() User {
+	return User{
+		FirstName:      req.FirstName,
+		LastName:       req.LastName,
+		MobileNumber:   req.MobileNumber,
+		EmailAddress:   req.EmailAddress,
+		DriverLicense:  toNullString(req.DriverLicense),
+		CarPlateNumber: toNullString(req.CarPlateNumber),
+		UserType:       req.UserType,
+	}
+}
+
+// newUserResponse converts the database model of a user into its response
+func newUserResponse(user User) UserResponse {
+	return UserResponse{
+		UserID:         user.UserID,
+		FirstName:      user.FirstName,
+		LastName:       user.LastName,
+		MobileNumber:   user.MobileNumber,
+		EmailAddress:   user.EmailAddress,
+		DriverLicense:  fromNullString(user.DriverLicense),
+		CarPlateNumber: fromNullString(user.CarPlateNumber),
+		CreationDate:   user.CreationDate,
+		LastUpdate:     user.LastUpdate,
+		DeletionDate:   fromNullString(user.DeletionDate),
+		UserType:       user.UserType,
+		EmailVerified:  user.EmailVerifiedDate.Valid,
+		PhotoURLs:      photoURLs(user.PhotoID),
+	}
+}
+
+// newOwnerApplicationResponse converts the database model of a car owner application into its response
+func newOwnerApplicationResponse(application OwnerApplication) OwnerApplicationResponse {
+	response := OwnerApplicationResponse{
+		ApplicationID:  application.ApplicationID,
+		UserID:         application.UserID,
+		DriverLicense:  application.DriverLicense,
+		CarPlateNumber: application.CarPlateNumber,
+		Status:         application.Status,
+		SubmissionDate: application.SubmissionDate,
+		ReviewDate:     fromNullString(application.ReviewDate),
+		ReviewNote:     fromNullString(application.ReviewNote),
+	}
+	if application.ReviewerID.Valid {
+		response.ReviewerID = &application.ReviewerID.Int64
+	}
+	return response
+}
+
+// toNullString converts an optional JSON string into a nullable column value, empty strings are stored as NULL
+func toNullString(value *string) sql.NullString {
+	if value == nil || *value == "" {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: *value, Valid: true}
+}
+
+// fromNullString converts a nullable column value into a JSON string or null
+func fromNullString(value sql.NullString) *string {
+	if !value.Valid {
+		return nil
+	}
+	return &value.String
+}
@@ -0,0 +1,512 @@
+// export.go
+
+package main
+
+// import all the necessary packages
+import (
+	"archive/zip"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a personal data export
+const (
+	exportPending = "pending"
+	exportReady   = "ready"
+	exportFailed  = "failed"
+	exportExpired = "expired"
+)
+
+// exportTTL is how long a finished export can be downloaded
+const exportTTL = 24 * time.Hour
+
+// exportBuildTimeout is how long an export may stay pending before it is considered lost, e.g. after a restart
+const exportBuildTimeout = 15 * time.Minute
+
+// tripExportColumns lists the CarPoolTrip columns scanned by scanExportTrip
+const tripExportColumns = "t.TripID, t.PickupAddress, t.AltPickupAddress, t.StartDateTime, t.DestinationAddress, t.AvailableSeats, t.TripStatus, t.PublishDate, t.EstimatedEndDateTime, t.TripDuration, t.CompletedDateTime, t.VehicleID"
+
+// DataExport represents a personal data export as returned to the client
+type DataExport struct {
+	ExportID      int     `json:"ExportID"`
+	UserID        int     `json:"UserID"`
+	Status        string  `json:"Status"`
+	RequestDate   string  `json:"RequestDate"`
+	CompletedDate *string `json:"CompletedDate"`
+	ExpiryDate    *string `json:"ExpiryDate"`
+	DownloadURL   *string `json:"DownloadURL"`
+}
+
+// ExportTrip is a trip as written to an export
+type ExportTrip struct {
+	TripID               int     `json:"TripID"`
+	PickupAddress        string  `json:"PickupAddress"`
+	AltPickupAddress     *string `json:"AltPickupAddress"`
+	StartDateTime        string  `json:"StartDateTime"`
+	DestinationAddress   string  `json:"DestinationAddress"`
+	AvailableSeats       int     `json:"AvailableSeats"`
+	TripStatus           string  `json:"TripStatus"`
+	PublishDate          string  `json:"PublishDate"`
+	EstimatedEndDateTime *string `json:"EstimatedEndDateTime"`
+	TripDuration         int     `json:"TripDuration"`
+	CompletedDateTime    *string `json:"CompletedDateTime"`
+	VehicleID            *int64  `json:"VehicleID"`
+}
+
+// ExportBooking is a booking of the user as written to an export, with the trip it is for
+type ExportBooking struct {
+	BookingID         int        `json:"BookingID"`
+	BookingDateTime   *string    `json:"BookingDateTime"`
+	BookingStatus     string     `json:"BookingStatus"`
+	CancelledDateTime *string    `json:"CancelledDateTime"`
+	Trip              ExportTrip `json:"Trip"`
+}
+
+// ExportArchive is the content of data.json in an export
+type ExportArchive struct {
+	ExportDate     string          `json:"ExportDate"`
+	Profile        UserResponse    `json:"Profile"`
+	Vehicles       []Vehicle       `json:"Vehicles"`
+	PublishedTrips []ExportTrip    `json:"PublishedTrips"`
+	Bookings       []ExportBooking `json:"Bookings"`
+}
+
+// exportDir is the folder the archives are written to, set with EXPORT_DIR
+func exportDir() string {
+	if dir := os.Getenv("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return "exports"
+}
+
+// exportSignature signs the download link of an export, so that it works without a login until it expires
+func exportSignature(exportID int, expires int64) string {
+	mac := hmac.New(sha256.New, tokenSecret)
+	fmt.Fprintf(mac, "data export:%d:%d", exportID, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// exportDownloadURL returns the signed download link of an export that expires at the given time
+func exportDownloadURL(exportID int, expiry time.Time) string {
+	expires := expiry.Unix()
+	return fmt.Sprintf("%s/api/v1/exports/%d/download?expires=%d&signature=%s", publicURL(), exportID, expires, exportSignature(exportID, expires))
+}
+
+// scanExportTrip scans a row selected with tripExportColumns, followed by any extra destinations
+func scanExportTrip(row interface{ Scan(...interface{}) error }, extra ...interface{}) (ExportTrip, error) {
+	var trip ExportTrip
+	var altPickup, estimatedEnd, completed sql.NullString
+	var vehicleID sql.NullInt64
+	dest := []interface{}{&trip.TripID, &trip.PickupAddress, &altPickup, &trip.StartDateTime, &trip.DestinationAddress,
+		&trip.AvailableSeats, &trip.TripStatus, &trip.PublishDate, &estimatedEnd, &trip.TripDuration, &completed, &vehicleID}
+	err := row.Scan(append(dest, extra...)...)
+	trip.AltPickupAddress = fromNullString(altPickup)
+	trip.EstimatedEndDateTime = fromNullString(estimatedEnd)
+	trip.CompletedDateTime = fromNullString(completed)
+	if vehicleID.Valid {
+		trip.VehicleID = &vehicleID.Int64
+	}
+	return trip, err
+}
+
+// collectExport reads the personal data of a user from the user and trip tables
+func collectExport(userID int, now time.Time) (ExportArchive, error) {
+	archive := ExportArchive{ExportDate: now.Format(dateTimeLayout), Vehicles: []Vehicle{}, PublishedTrips: []ExportTrip{}, Bookings: []ExportBooking{}}
+	user, err := loadUser(userID)
+	if err != nil {
+		return archive, err
+	}
+	archive.Profile = newUserResponse(user)
+
+	// Vehicles the user registered, including the ones removed since
+	rows, err := db.Query("SELECT "+vehicleColumns+" FROM CarPoolVehicle WHERE UserID = ? ORDER BY VehicleID", userID)
+	if err != nil {
+		return archive, err
+	}
+	for rows.Next() {
+		vehicle, err := scanVehicle(rows)
+		if err != nil {
+			rows.Close()
+			return archive, err
+		}
+		archive.Vehicles = append(archive.Vehicles, vehicle)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return archive, err
+	}
+
+	// Trips the user published as a car owner
+	rows, err = db.Query("SELECT "+tripExportColumns+" FROM CarPoolTrip t WHERE t.UserID = ? ORDER BY t.TripID", userID)
+	if err != nil {
+		return archive, err
+	}
+	for rows.Next() {
+		trip, err := scanExportTrip(rows)
+		if err != nil {
+			rows.Close()
+			return archive, err
+		}
+		archive.PublishedTrips = append(archive.PublishedTrips, trip)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return archive, err
+	}
+
+	// Trips the user booked as a passenger
+	rows, err = db.Query(
+		"SELECT "+tripExportColumns+", b.BookingID, b.BookingDateTime, b.BookingStatus, b.CancelledDateTime FROM CarPoolBooking b JOIN CarPoolTrip t ON b.TripID = t.TripID WHERE b.PassengerID = ? ORDER BY b.BookingID",
+		userID,
+	)
+	if err != nil {
+		return archive, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var booking ExportBooking
+		var bookingDate, cancelledDate sql.NullString
+		booking.Trip, err = scanExportTrip(rows, &booking.BookingID, &bookingDate, &booking.BookingStatus, &cancelledDate)
+		if err != nil {
+			return archive, err
+		}
+		booking.BookingDateTime = fromNullString(bookingDate)
+		booking.CancelledDateTime = fromNullString(cancelledDate)
+		archive.Bookings = append(archive.Bookings, booking)
+	}
+	return archive, rows.Err()
+}
+
+// text returns the CSV cell of an optional value
+func text(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// tripRecord returns the CSV cells of a trip
+func tripRecord(trip ExportTrip) []string {
+	vehicleID := ""
+	if trip.VehicleID != nil {
+		vehicleID = strconv.FormatInt(*trip.VehicleID, 10)
+	}
+	return []string{strconv.Itoa(trip.TripID), trip.PickupAddress, text(trip.AltPickupAddress), trip.StartDateTime,
+		trip.DestinationAddress, strconv.Itoa(trip.AvailableSeats), trip.TripStatus, trip.PublishDate,
+		text(trip.EstimatedEndDateTime), strconv.Itoa(trip.TripDuration), text(trip.CompletedDateTime), vehicleID}
+}
+
+// tripHeader is the CSV header of tripRecord
+var tripHeader = []string{"TripID", "PickupAddress", "AltPickupAddress", "StartDateTime", "DestinationAddress",
+	"AvailableSeats", "TripStatus", "PublishDate", "EstimatedEndDateTime", "TripDuration", "CompletedDateTime", "VehicleID"}
+
+// writeCSV adds a CSV file to the archive
+func writeCSV(archive *zip.Writer, name string, records [][]string) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	writer := csv.NewWriter(file)
+	writer.WriteAll(records)
+	return writer.Error()
+}
+
+// writeExportArchive writes the data as data.json and one CSV file per table
+func writeExportArchive(out io.Writer, data ExportArchive) error {
+	archive := zip.NewWriter(out)
+
+	file, err := archive.Create("data.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		return err
+	}
+
+	profile := data.Profile
+	err = writeCSV(archive, "profile.csv", [][]string{
+		{"UserID", "FirstName", "LastName", "MobileNumber", "EmailAddress", "DriverLicense", "CarPlateNumber", "CreationDate", "LastUpdate", "DeletionDate", "UserType", "EmailVerified"},
+		{strconv.Itoa(profile.UserID), profile.FirstName, profile.LastName, profile.MobileNumber, profile.EmailAddress,
+			text(profile.DriverLicense), text(profile.CarPlateNumber), profile.CreationDate, profile.LastUpdate,
+			text(profile.DeletionDate), profile.UserType, strconv.FormatBool(profile.EmailVerified)},
+	})
+	if err != nil {
+		return err
+	}
+
+	vehicles := [][]string{{"VehicleID", "Make", "Model", "Colour", "CarPlateNumber", "PassengerCapacity", "CreationDate", "LastUpdate"}}
+	for _, vehicle := range data.Vehicles {
+		vehicles = append(vehicles, []string{strconv.Itoa(vehicle.VehicleID), vehicle.Make, vehicle.Model, vehicle.Colour,
+			vehicle.CarPlateNumber, strconv.Itoa(vehicle.PassengerCapacity), vehicle.CreationDate, vehicle.LastUpdate})
+	}
+	if err := writeCSV(archive, "vehicles.csv", vehicles); err != nil {
+		return err
+	}
+
+	trips := [][]string{tripHeader}
+	for _, trip := range data.PublishedTrips {
+		trips = append(trips, tripRecord(trip))
+	}
+	if err := writeCSV(archive, "published_trips.csv", trips); err != nil {
+		return err
+	}
+
+	bookings := [][]string{append([]string{"BookingID", "BookingDateTime", "BookingStatus", "CancelledDateTime"}, tripHeader...)}
+	for _, booking := range data.Bookings {
+		bookings = append(bookings, append([]string{strconv.Itoa(booking.BookingID), text(booking.BookingDateTime), booking.BookingStatus, text(booking.CancelledDateTime)}, tripRecord(booking.Trip)...))
+	}
+	if err := writeCSV(archive, "bookings.csv", bookings); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// buildDataExport assembles the archive of an export in the background and emails the download link when it is ready
+func buildDataExport(exportID, userID int) {
+	now := time.Now()
+	fail := func(err error) {
+		fmt.Println("export", exportID, err)
+		if _, err := db.Exec("UPDATE CarPoolDataExport SET Status = ?, CompletedDate = ? WHERE ExportID = ?", exportFailed, time.Now().Format(dateTimeLayout), exportID); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	data, err := collectExport(userID, now)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	// The file name is random so that it cannot be guessed from the export ID
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		fail(err)
+		return
+	}
+	if err := os.MkdirAll(exportDir(), 0700); err != nil {
+		fail(err)
+		return
+	}
+	path := filepath.Join(exportDir(), fmt.Sprintf("export-%d-%s.zip", exportID, hex.EncodeToString(suffix)))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		fail(err)
+		return
+	}
+	err = writeExportArchive(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		fail(err)
+		return
+	}
+
+	completed := time.Now()
+	expiry := completed.Add(exportTTL)
+	_, err = db.Exec(
+		"UPDATE CarPoolDataExport SET Status = ?, CompletedDate = ?, ExpiryDate = ?, FilePath = ? WHERE ExportID = ? AND Status = ?",
+		exportReady, completed.Format(dateTimeLayout), expiry.Format(dateTimeLayout), path, exportID, exportPending,
+	)
+	if err != nil {
+		os.Remove(path)
+		fail(err)
+		return
+	}
+
+	body := "Hi " + data.Profile.FirstName + ",\n\n" +
+		"The copy of your car-pooling data that you asked for is ready. Download it within 24 hours from:\n\n" +
+		exportDownloadURL(exportID, expiry) + "\n\n" +
+		"If you did not ask for it, please change your password."
+	if err := mailer.Send(data.Profile.EmailAddress, "Your data export is ready", body); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// expireDataExports removes the archives of expired exports and fails the ones whose build was lost
+func expireDataExports(now time.Time) error {
+	rows, err := db.Query("SELECT ExportID, FilePath FROM CarPoolDataExport WHERE Status = ? AND ExpiryDate <= ?", exportReady, now.Format(dateTimeLayout))
+	if err != nil {
+		return err
+	}
+	expired := map[int]string{}
+	for rows.Next() {
+		var exportID int
+		var path string
+		if err := rows.Scan(&exportID, &path); err != nil {
+			rows.Close()
+			return err
+		}
+		expired[exportID] = path
+	}
+	rows.Close()
+
+	for exportID, path := range expired {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			fmt.Println(err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE CarPoolDataExport SET Status = ?, FilePath = NULL WHERE ExportID = ?", exportExpired, exportID); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.Exec(
+		"UPDATE CarPoolDataExport SET Status = ?, CompletedDate = ? WHERE Status = ? AND RequestDate <= ?",
+		exportFailed, now.Format(dateTimeLayout), exportPending, now.Add(-exportBuildTimeout).Format(dateTimeLayout),
+	)
+	return err
+}
+
+// loadDataExport returns an export of a user, with its download link while it can be downloaded
+func loadDataExport(userID, exportID interface{}) (DataExport, error) {
+	var export DataExport
+	var completedDate, expiryDate sql.NullString
+	err := db.QueryRow(
+		"SELECT ExportID, UserID, Status, RequestDate, CompletedDate, ExpiryDate FROM CarPoolDataExport WHERE UserID = ? AND ExportID = ?",
+		userID, exportID,
+	).Scan(&export.ExportID, &export.UserID, &export.Status, &export.RequestDate, &completedDate, &expiryDate)
+	if err != nil {
+		return export, err
+	}
+	export.CompletedDate = fromNullString(completedDate)
+	export.ExpiryDate = fromNullString(expiryDate)
+
+	if export.Status == exportReady && expiryDate.Valid {
+		expiry, err := time.ParseInLocation(dateTimeLayout, expiryDate.String, time.Local)
+		if err != nil {
+			return export, err
+		}
+		if expiry.After(time.Now()) {
+			url := exportDownloadURL(export.ExportID, expiry)
+			export.DownloadURL = &url
+		} else {
+			export.Status = exportExpired
+		}
+	}
+	return export, nil
+}
+
+// requestDataExport starts assembling an archive of the user's personal data
+func requestDataExport(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, _ := strconv.Atoi(params["userID"])
+
+	// Only one export is assembled at a time
+	var pending int
+	err := db.QueryRow("SELECT COUNT(*) FROM CarPoolDataExport WHERE UserID = ? AND Status = ?", userID, exportPending).Scan(&pending)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if pending > 0 {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "An export is already being prepared"})
+		return
+	}
+
+	now := time.Now().Format(dateTimeLayout)
+	result, err := db.Exec("INSERT INTO CarPoolDataExport (UserID, Status, RequestDate) VALUES (?, ?, ?)", userID, exportPending, now)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	exportID, err := result.LastInsertId()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	go buildDataExport(int(exportID), userID)
+
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/users/%d/exports/%d", userID, exportID))
+	jsonResponse(w, http.StatusAccepted, DataExport{ExportID: int(exportID), UserID: userID, Status: exportPending, RequestDate: now})
+}
+
+// getDataExport returns the status of an export, with its download link once it is ready
+func getDataExport(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID and export ID from the request parameters
+	params := mux.Vars(r)
+
+	export, err := loadDataExport(params["userID"], params["exportID"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Export not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	jsonResponse(w, http.StatusOK, export)
+}
+
+// downloadDataExport serves the archive of an export to the holder of its signed link
+func downloadDataExport(w http.ResponseWriter, r *http.Request) {
+	// Get the export ID from the request parameters
+	params := mux.Vars(r)
+	exportID, err := strconv.Atoi(params["exportID"])
+	if err != nil {
+		http.Error(w, "Invalid download link", http.StatusNotFound)
+		return
+	}
+
+	// Check the signature and the expiry of the link
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	signature := r.URL.Query().Get("signature")
+	if err != nil || !hmac.Equal([]byte(signature), []byte(exportSignature(exportID, expires))) {
+		http.Error(w, "Invalid download link", http.StatusNotFound)
+		return
+	}
+	if time.Now().Unix() >= expires {
+		http.Error(w, "Download link has expired", http.StatusGone)
+		return
+	}
+
+	var path string
+	err = db.QueryRow("SELECT FilePath FROM CarPoolDataExport WHERE ExportID = ? AND Status = ?", exportID, exportReady).Scan(&path)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "Download link has expired", http.StatusGone)
+		} else {
+			fmt.Println(err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Download link has expired", http.StatusGone)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="carpool-data-%d.zip"`, exportID))
+	w.Header().Set("Cache-Control", "no-store")
+	if _, err := io.Copy(w, file); err != nil {
+		fmt.Println(err)
+	}
+}
@@ -0,0 +1,84 @@
+// formats.go
+
+package main
+
+// import all the necessary packages
+import (
+	"regexp"
+	"strings"
+)
+
+// carPlatePattern matches a Singapore vehicle registration number: a 1-3 letter prefix, up to 4 digits and a checksum letter
+var carPlatePattern = regexp.MustCompile(`^([A-Z]{1,3})([1-9][0-9]{0,3})([A-Z])$`)
+
+// carPlateChecksumLetters maps the remainder of the weighted sum to the checksum letter of a car plate
+const carPlateChecksumLetters = "AZYXUTSRPMLKJHGEDCB"
+
+// driverLicensePattern matches the NRIC or FIN used as a Singapore driving licence number
+var driverLicensePattern = regexp.MustCompile(`^([STFGM])([0-9]{7})([A-Z])$`)
+
+// normalizeIdentifier upper-cases an identifier and removes the spaces users tend to type in it
+func normalizeIdentifier(value string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(value), " ", ""))
+}
+
+// isValidCarPlate reports whether a normalised car plate number has a valid Singapore format and checksum letter
+func isValidCarPlate(plate string) bool {
+	match := carPlatePattern.FindStringSubmatch(plate)
+	if match == nil {
+		return false
+	}
+	prefix, digits, checksum := match[1], match[2], match[3]
+
+	// Only the last two letters of the prefix count, a single letter prefix is treated as if it started with a blank
+	var letters [2]int
+	if len(prefix) == 1 {
+		letters[1] = int(prefix[0]-'A') + 1
+	} else {
+		letters[0] = int(prefix[len(prefix)-2]-'A') + 1
+		letters[1] = int(prefix[len(prefix)-1]-'A') + 1
+	}
+
+	// The number is padded to four digits
+	digits = strings.Repeat("0", 4-len(digits)) + digits
+
+	// Weighted sum of the two letters and four digits
+	sum := letters[0]*9 + letters[1]*4
+	for i, weight := range []int{5, 4, 3, 2} {
+		sum += int(digits[i]-'0') * weight
+	}
+	return carPlateChecksumLetters[sum%19] == checksum[0]
+}
+
+// isValidDriverLicense reports whether a normalised driving licence number is a valid NRIC or FIN
+func isValidDriverLicense(license string) bool {
+	match := driverLicensePattern.FindStringSubmatch(license)
+	if match == nil {
+		return false
+	}
+	series, digits, checksum := match[1][0], match[2], match[3][0]
+
+	// Weighted sum of the seven digits, offset by the series
+	sum := 0
+	for i, weight := range []int{2, 7, 6, 5, 4, 3, 2} {
+		sum += int(digits[i]-'0') * weight
+	}
+	switch series {
+	case 'T', 'G':
+		sum += 4
+	case 'M':
+		sum += 3
+	}
+
+	// Each series has its own table of checksum letters
+	var table string
+	switch series {
+	case 'S', 'T':
+		table = "JZIHGFEDCBA"
+	case 'F', 'G':
+		table = "XWUTRQPNMLK"
+	case 'M':
+		table = "XWUTRQPNJLK"
+	}
+	return table[sum%11] == checksum
+}
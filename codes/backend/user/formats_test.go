@@ -0,0 +1,86 @@
+// formats_test.go
+
+package main
+
+// import all the necessary packages
+import "testing"
+
+// TestIsValidCarPlate checks the format and checksum letter of car plate numbers
+func TestIsValidCarPlate(t *testing.T) {
+	tests := []struct {
+		plate string
+		valid bool
+	}{
+		// Three letter prefix, only the last two letters count
+		{"SBA1234G", true},
+		{"SBA1234A", false},
+		// Two letter prefix
+		{"BA1234G", true},
+		// Single letter prefix, treated as if it started with a blank
+		{"S1234K", true},
+		{"S1234A", false},
+		// Numbers shorter than four digits are padded
+		{"SBA1A", false},
+		{"SBA1T", true},
+		// Malformed plates
+		{"", false},
+		{"SBA0123G", false},
+		{"SBA12345G", false},
+		{"SBAA1234G", false},
+		{"SBA1234", false},
+		{"sba1234g", false},
+	}
+	for _, test := range tests {
+		if got := isValidCarPlate(test.plate); got != test.valid {
+			t.Errorf("isValidCarPlate(%q) = %v, want %v", test.plate, got, test.valid)
+		}
+	}
+}
+
+// TestIsValidDriverLicense checks the series and checksum letter of NRIC and FIN numbers
+func TestIsValidDriverLicense(t *testing.T) {
+	tests := []struct {
+		license string
+		valid   bool
+	}{
+		// One valid number per series, the T, G and M series offset the weighted sum
+		{"S1234567D", true},
+		{"T1234567J", true},
+		{"F1234567N", true},
+		{"G1234567X", true},
+		{"M1234567K", true},
+		// Wrong checksum letters, including the letter of another series
+		{"S1234567A", false},
+		{"T1234567D", false},
+		{"F1234567X", false},
+		{"M1234567N", false},
+		// Malformed numbers
+		{"", false},
+		{"A1234567D", false},
+		{"S123456D", false},
+		{"S12345678D", false},
+		{"s1234567d", false},
+	}
+	for _, test := range tests {
+		if got := isValidDriverLicense(test.license); got != test.valid {
+			t.Errorf("isValidDriverLicense(%q) = %v, want %v", test.license, got, test.valid)
+		}
+	}
+}
+
+// TestNormalizeIdentifier checks that typed identifiers are normalised before they are validated
+func TestNormalizeIdentifier(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"SBA1234G", "SBA1234G"},
+		{" sba 1234 g ", "SBA1234G"},
+		{"s1234567d", "S1234567D"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := normalizeIdentifier(test.value); got != test.want {
+			t.Errorf("normalizeIdentifier(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
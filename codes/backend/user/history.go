@@ -0,0 +1,198 @@
+// history.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions recorded in the profile history
+const (
+	historyRegistered        = "registered"
+	historyProfileUpdated    = "profile updated"
+	historyPasswordChanged   = "password changed"
+	historyPasswordReset     = "password reset"
+	historyEmailVerified     = "email verified"
+	historyOwnerApproved     = "car owner approved"
+	historyOwnerDowngraded   = "downgraded to passenger"
+	historyCarDetailsChanged = "car details approved"
+	historyTwoFactorEnabled  = "two-factor enabled"
+	historyTwoFactorRemoved  = "two-factor disabled"
+	historyAccountDeleted    = "account deleted"
+	historyAccountSuspended  = "account suspended"
+	historyAccountReinstated = "account reinstated"
+	historyPhotoChanged      = "profile photo changed"
+)
+
+// redactedValue replaces the old and new values of secret fields
+const redactedValue = "[redacted]"
+
+// redactedFields are never written to the history in clear
+var redactedFields = map[string]bool{
+	"UserPassword": true,
+}
+
+// Page size of the history endpoint
+const (
+	historyDefaultLimit = 50
+	historyMaxLimit     = 200
+)
+
+// FieldChange is the old and new value of one field changed by a profile mutation
+type FieldChange struct {
+	Field    string
+	OldValue sql.NullString
+	NewValue sql.NullString
+}
+
+// HistoryEntry represents one recorded field change as returned to the client
+type HistoryEntry struct {
+	HistoryID  int     `json:"HistoryID"`
+	ChangeDate string  `json:"ChangeDate"`
+	ChangedBy  *int64  `json:"ChangedBy"`
+	IPAddress  *string `json:"IPAddress"`
+	Action     string  `json:"Action"`
+	Field      string  `json:"Field"`
+	OldValue   *string `json:"OldValue"`
+	NewValue   *string `json:"NewValue"`
+}
+
+// execer is satisfied by both the database and a transaction, so that history can be written alongside the change
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// textValue wraps a string that is always set as a field value
+func textValue(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: true}
+}
+
+// profileChanges lists the profile fields that differ between two versions of a user
+func profileChanges(before, after User) []FieldChange {
+	fields := []FieldChange{
+		{"FirstName", textValue(before.FirstName), textValue(after.FirstName)},
+		{"LastName", textValue(before.LastName), textValue(after.LastName)},
+		{"MobileNumber", textValue(before.MobileNumber), textValue(after.MobileNumber)},
+		{"EmailAddress", textValue(before.EmailAddress), textValue(after.EmailAddress)},
+		{"DriverLicense", before.DriverLicense, after.DriverLicense},
+		{"CarPlateNumber", before.CarPlateNumber, after.CarPlateNumber},
+		{"UserType", textValue(before.UserType), textValue(after.UserType)},
+	}
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if field.OldValue != field.NewValue {
+			changes = append(changes, field)
+		}
+	}
+	return changes
+}
+
+// historyActor returns the account that made a change, the caller of an authenticated request or else the user itself
+func historyActor(r *http.Request, userID int) int64 {
+	if claims := claimsFromContext(r); claims != nil {
+		if actor, err := strconv.ParseInt(claims.Subject, 10, 64); err == nil {
+			return actor
+		}
+	}
+	return int64(userID)
+}
+
+// recordHistory writes one history row per changed field, with the values of secret fields redacted
+func recordHistory(exec execer, r *http.Request, userID int, action string, changes []FieldChange) error {
+	now := time.Now().Format(dateTimeLayout)
+	actor := historyActor(r, userID)
+	ip := clientIP(r)
+	for _, change := range changes {
+		if redactedFields[change.Field] {
+			if change.OldValue.Valid {
+				change.OldValue = textValue(redactedValue)
+			}
+			if change.NewValue.Valid {
+				change.NewValue = textValue(redactedValue)
+			}
+		}
+		_, err := exec.Exec(
+			"INSERT INTO CarPoolUserHistory (UserID, ChangedBy, ChangeDate, IPAddress, Action, FieldName, OldValue, NewValue) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			userID, actor, now, ip, action, change.Field, change.OldValue, change.NewValue,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getUserHistory lists the recorded profile changes of a user, newest first.
+// Use limit to set the page size and before with the last HistoryID of a page to get the next one.
+func getUserHistory(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	limit := historyDefaultLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > historyMaxLimit {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": fmt.Sprintf("limit must be between 1 and %d", historyMaxLimit)})
+			return
+		}
+		limit = parsed
+	}
+	query := "SELECT HistoryID, ChangeDate, ChangedBy, IPAddress, Action, FieldName, OldValue, NewValue FROM CarPoolUserHistory WHERE UserID = ?"
+	args := []interface{}{userID}
+	if value := r.URL.Query().Get("before"); value != "" {
+		before, err := strconv.Atoi(value)
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "before must be a HistoryID"})
+			return
+		}
+		query += " AND HistoryID < ?"
+		args = append(args, before)
+	}
+	query += " ORDER BY HistoryID DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	// The IP addresses of admins are only shown to admins
+	claims := claimsFromContext(r)
+	showAllIPs := can(claims.UserType, actionAccessAnyUser)
+
+	// Add the data into the struct
+	entries := []HistoryEntry{}
+	for rows.Next() {
+		var entry HistoryEntry
+		var changedBy sql.NullInt64
+		var ipAddress, oldValue, newValue sql.NullString
+		err := rows.Scan(&entry.HistoryID, &entry.ChangeDate, &changedBy, &ipAddress, &entry.Action, &entry.Field, &oldValue, &newValue)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		if changedBy.Valid {
+			entry.ChangedBy = &changedBy.Int64
+		}
+		if showAllIPs || strconv.FormatInt(changedBy.Int64, 10) == claims.Subject {
+			entry.IPAddress = fromNullString(ipAddress)
+		}
+		entry.OldValue = fromNullString(oldValue)
+		entry.NewValue = fromNullString(newValue)
+		entries = append(entries, entry)
+	}
+
+	jsonResponse(w, http.StatusOK, entries)
+}
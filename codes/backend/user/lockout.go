@@ -0,0 +1,252 @@
+// lockout.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of login throttle keys, failures are counted per email address and per client IP address
+const (
+	throttleAccount = "account"
+	throttleIP      = "ip"
+)
+
+// loginThrottlePolicy describes when failed logins for one kind of key are slowed down and locked out
+type loginThrottlePolicy struct {
+	BackoffAfter int // failures before every further attempt has to wait
+	LockoutAfter int // failures before the key is locked out
+}
+
+// loginThrottlePolicies holds the policy of each kind of key, an IP address may be shared by many users
+var loginThrottlePolicies = map[string]loginThrottlePolicy{
+	throttleAccount: {BackoffAfter: 3, LockoutAfter: 10},
+	throttleIP:      {BackoffAfter: 20, LockoutAfter: 100},
+}
+
+// Timing of the login throttle
+const (
+	loginBackoffBase  = time.Second      // wait after the first failure past the backoff threshold, doubled for each further one
+	loginBackoffMax   = 5 * time.Minute  // longest backoff before a lockout
+	loginLockout      = 30 * time.Minute // duration of a lockout
+	loginFailureReset = time.Hour        // failures older than this are forgotten
+)
+
+// Lockout represents a temporary lockout of an email address or IP address after repeated failed logins
+type Lockout struct {
+	LockoutID    int     `json:"LockoutID"`
+	KeyType      string  `json:"KeyType"`
+	KeyValue     string  `json:"KeyValue"`
+	FailureCount int     `json:"FailureCount"`
+	LockedDate   string  `json:"LockedDate"`
+	LockedUntil  string  `json:"LockedUntil"`
+	ClearedDate  *string `json:"ClearedDate"`
+	ClearedBy    *int64  `json:"ClearedBy"`
+}
+
+// loginThrottleKeys returns the throttle keys of a login attempt
+func loginThrottleKeys(emailAddress string, r *http.Request) map[string]string {
+	return map[string]string{
+		throttleAccount: normalizeEmail(emailAddress),
+		throttleIP:      clientIP(r),
+	}
+}
+
+// reauthThrottleKeys checks the login throttle before a signed in user confirms their password or a code, which counts
+// as a login attempt for their email address. It answers 429 Too Many Requests when they have to wait, and otherwise
+// returns the keys to record the outcome with. A stolen access token cannot be used to guess the password or code faster than a login.
+func reauthThrottleKeys(w http.ResponseWriter, r *http.Request, userID int, now time.Time) (map[string]string, bool) {
+	var emailAddress string
+	if err := db.QueryRow("SELECT EmailAddress FROM CarPoolUser WHERE UserID = ?", userID).Scan(&emailAddress); err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return nil, false
+	}
+
+	keys := loginThrottleKeys(emailAddress, r)
+	wait, err := loginBlockedFor(keys, now)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return nil, false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		jsonResponse(w, http.StatusTooManyRequests, map[string]interface{}{"Message": "Too many failed attempts, please try again later"})
+		return nil, false
+	}
+	return keys, true
+}
+
+// loginBlockedFor returns how long the login attempt has to wait, or zero when it may go ahead
+func loginBlockedFor(keys map[string]string, now time.Time) (time.Duration, error) {
+	var wait time.Duration
+	for keyType, keyValue := range keys {
+		var blockedUntil sql.NullString
+		err := db.QueryRow("SELECT BlockedUntil FROM CarPoolLoginThrottle WHERE KeyType = ? AND KeyValue = ?", keyType, keyValue).Scan(&blockedUntil)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, err
+		}
+		if !blockedUntil.Valid {
+			continue
+		}
+
+		until, err := time.ParseInLocation(dateTimeLayout, blockedUntil.String, time.Local)
+		if err != nil {
+			return 0, err
+		}
+		if remaining := until.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login for every key, and applies the backoff or lockout it leads to
+func recordLoginFailure(keys map[string]string, userID sql.NullInt64, now time.Time) error {
+	for keyType, keyValue := range keys {
+		policy := loginThrottlePolicies[keyType]
+
+		// Count the failure atomically, starting again when the previous failures are old
+		_, err := db.Exec(`
+			INSERT INTO CarPoolLoginThrottle (KeyType, KeyValue, FailureCount, LastFailure) VALUES (?, ?, 1, ?)
+			ON DUPLICATE KEY UPDATE
+				FailureCount = IF(LastFailure < ?, 1, FailureCount + 1),
+				LastFailure = VALUES(LastFailure)`,
+			keyType, keyValue, now.Format(dateTimeLayout), now.Add(-loginFailureReset).Format(dateTimeLayout),
+		)
+		if err != nil {
+			return err
+		}
+
+		var failures int
+		err = db.QueryRow("SELECT FailureCount FROM CarPoolLoginThrottle WHERE KeyType = ? AND KeyValue = ?", keyType, keyValue).Scan(&failures)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case failures >= policy.LockoutAfter:
+			// Lock the key out and record it for the admins
+			lockedUntil := now.Add(loginLockout).Format(dateTimeLayout)
+			_, err = db.Exec("UPDATE CarPoolLoginThrottle SET BlockedUntil = ?, FailureCount = 0 WHERE KeyType = ? AND KeyValue = ?", lockedUntil, keyType, keyValue)
+			if err != nil {
+				return err
+			}
+			if keyType != throttleAccount {
+				userID = sql.NullInt64{}
+			}
+			_, err = db.Exec(
+				"INSERT INTO CarPoolLockout (KeyType, KeyValue, UserID, FailureCount, LockedDate, LockedUntil) VALUES (?, ?, ?, ?, ?, ?)",
+				keyType, keyValue, userID, failures, now.Format(dateTimeLayout), lockedUntil,
+			)
+		case failures >= policy.BackoffAfter:
+			// Double the wait with every failure past the threshold
+			backoff := time.Duration(float64(loginBackoffBase) * math.Pow(2, float64(failures-policy.BackoffAfter)))
+			if backoff > loginBackoffMax {
+				backoff = loginBackoffMax
+			}
+			_, err = db.Exec("UPDATE CarPoolLoginThrottle SET BlockedUntil = ? WHERE KeyType = ? AND KeyValue = ?", now.Add(backoff).Format(dateTimeLayout), keyType, keyValue)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordLoginSuccess forgets the failures of the account, failures of the IP address are kept
+func recordLoginSuccess(keys map[string]string) error {
+	_, err := db.Exec("DELETE FROM CarPoolLoginThrottle WHERE KeyType = ? AND KeyValue = ?", throttleAccount, keys[throttleAccount])
+	return err
+}
+
+// writeLoginBlocked answers a throttled login attempt without telling whether the email address exists
+func writeLoginBlocked(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	jsonResponse(w, http.StatusTooManyRequests, map[string]interface{}{"Message": "Too many failed login attempts, please try again later"})
+}
+
+// listLockouts lists the lockouts for admins, only the active ones unless all=true is given
+func listLockouts(w http.ResponseWriter, r *http.Request) {
+	query := "SELECT LockoutID, KeyType, KeyValue, FailureCount, LockedDate, LockedUntil, ClearedDate, ClearedBy FROM CarPoolLockout"
+	args := []interface{}{}
+	if r.URL.Query().Get("all") != "true" {
+		query += " WHERE ClearedDate IS NULL AND LockedUntil > ?"
+		args = append(args, time.Now().Format(dateTimeLayout))
+	}
+	query += " ORDER BY LockedDate DESC"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	// Add the data into the struct
+	lockouts := []Lockout{}
+	for rows.Next() {
+		var lockout Lockout
+		var clearedDate sql.NullString
+		var clearedBy sql.NullInt64
+		err := rows.Scan(&lockout.LockoutID, &lockout.KeyType, &lockout.KeyValue, &lockout.FailureCount, &lockout.LockedDate, &lockout.LockedUntil, &clearedDate, &clearedBy)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		lockout.ClearedDate = fromNullString(clearedDate)
+		if clearedBy.Valid {
+			lockout.ClearedBy = &clearedBy.Int64
+		}
+		lockouts = append(lockouts, lockout)
+	}
+
+	jsonResponse(w, http.StatusOK, lockouts)
+}
+
+// clearLockout lifts a lockout before it expires and forgets the failures of its key
+func clearLockout(w http.ResponseWriter, r *http.Request) {
+	// Get the lockout ID from the request parameters
+	params := mux.Vars(r)
+	lockoutID := params["lockoutID"]
+
+	var keyType, keyValue string
+	err := db.QueryRow("SELECT KeyType, KeyValue FROM CarPoolLockout WHERE LockoutID = ? AND ClearedDate IS NULL", lockoutID).Scan(&keyType, &keyValue)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Lockout not found or already cleared"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+
+	// Record who cleared it, then unblock the key
+	_, err = db.Exec("UPDATE CarPoolLockout SET ClearedDate = ?, ClearedBy = ? WHERE LockoutID = ?", time.Now().Format(dateTimeLayout), claimsFromContext(r).Subject, lockoutID)
+	if err == nil {
+		_, err = db.Exec("DELETE FROM CarPoolLoginThrottle WHERE KeyType = ? AND KeyValue = ?", keyType, keyValue)
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Lockout cleared"})
+}
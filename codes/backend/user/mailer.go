@@ -0,0 +1,111 @@
+// mailer.go
+
+package main
+
+// import all the necessary packages
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// mailer is the transport used by the user service, chosen with the MAILER environment variable
+var mailer Mailer
+
+// SMTPMailer sends emails through an SMTP server
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+// Send delivers a plain text email through the SMTP server
+func (m SMTPMailer) Send(to, subject, body string) error {
+	// Line breaks are removed so that the recipient and subject stay single headers,
+	// and anything beyond printable ASCII in the subject is sent as an encoded word
+	singleLine := strings.NewReplacer("\r", " ", "\n", " ")
+	to, subject = singleLine.Replace(to), singleLine.Replace(subject)
+	message := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		strings.ReplaceAll(body, "\n", "\r\n")
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(message))
+}
+
+// WriterMailer writes emails to a file or to stdout instead of sending them, for development and offline testing
+type WriterMailer struct {
+	mu  sync.Mutex
+	Out io.Writer
+}
+
+// Send writes the email to the output
+func (m *WriterMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintf(m.Out, "----- %s\nTo: %s\nSubject: %s\n\n%s\n\n", time.Now().Format(dateTimeLayout), to, subject, body)
+	return err
+}
+
+// loadMailerConfig chooses the mail transport from the environment:
+// MAILER=smtp uses SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD and MAIL_FROM,
+// MAILER=file appends to MAIL_FILE, and anything else prints to stdout
+func loadMailerConfig() {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		host, port, from := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT"), os.Getenv("MAIL_FROM")
+		if host == "" || from == "" {
+			log.Fatal("MAILER=smtp requires SMTP_HOST and MAIL_FROM")
+		}
+		if port == "" {
+			port = "587"
+		}
+		var auth smtp.Auth
+		if username := os.Getenv("SMTP_USERNAME"); username != "" {
+			auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+		}
+		mailer = SMTPMailer{Addr: host + ":" + port, Auth: auth, From: from}
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			path = "mail.log"
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mailer = &WriterMailer{Out: file}
+	default:
+		mailer = &WriterMailer{Out: os.Stdout}
+	}
+}
+
+// frontendURL is the address of the web application, used in links that open one of its pages
+func frontendURL() string {
+	if url := os.Getenv("FRONTEND_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:3000"
+}
+
+// publicURL is the address of the user service as seen by users, used in the links sent by email
+func publicURL() string {
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:5000"
+}
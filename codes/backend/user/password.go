@@ -0,0 +1,81 @@
+// password.go
+
+package main
+
+// import all the necessary packages
+import (
+	"crypto/subtle"
+	"log"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// bcryptCost is the work factor used when hashing passwords, it can be overridden with the BCRYPT_COST environment variable
+var bcryptCost = bcrypt.DefaultCost
+
+// loadPasswordConfig reads the password hashing settings from the environment and prepares the dummy hash with the same cost
+func loadPasswordConfig() {
+	if value := os.Getenv("BCRYPT_COST"); value != "" {
+		// Reject costs that bcrypt itself would refuse
+		cost, err := strconv.Atoi(value)
+		if err != nil || cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+			log.Fatalf("invalid BCRYPT_COST %q, expected a number between %d and %d", value, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		bcryptCost = cost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcryptCost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dummyPasswordHash = hash
+}
+
+// dummyPasswordHash is compared against when no account matches a login, so that unknown email addresses take as long as wrong passwords.
+// It is hashed with bcryptCost by loadPasswordConfig, a different cost would make the check faster or slower than a real one.
+var dummyPasswordHash []byte
+
+// burnPasswordCheck spends the time of a password check without a stored password to check against
+func burnPasswordCheck(password string) {
+	bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+}
+
+// hashPassword returns the salted bcrypt hash of a plaintext password
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// isPasswordHash reports whether a stored password is already a bcrypt hash rather than legacy plaintext
+func isPasswordHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// checkPassword compares a plaintext password against the stored value and reports whether it matches
+// and whether the stored value should be rehashed (legacy plaintext or an outdated cost)
+func checkPassword(stored, password string) (match bool, needsRehash bool) {
+	// Purged accounts have no password at all
+	if stored == "" {
+		return false, false
+	}
+
+	// Legacy rows still hold the plaintext password
+	if !isPasswordHash(stored) {
+		match = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+		return match, match
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) != nil {
+		return false, false
+	}
+
+	// Upgrade hashes created with a different cost than the one currently configured
+	cost, _ := bcrypt.Cost([]byte(stored))
+	return true, cost != bcryptCost
+}
@@ -0,0 +1,346 @@
+// photo.go
+
+package main
+
+// import all the necessary packages
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// maxPhotoSize is the largest profile photo that can be uploaded, in bytes
+const maxPhotoSize = 5 << 20
+
+// maxPhotoPixels is the largest image, in pixels, that is decoded, so that a small file cannot expand into a huge image
+const maxPhotoPixels = 40_000_000
+
+// photoSizes are the square thumbnails stored for every profile photo, by name and side length in pixels
+var photoSizes = map[string]int{
+	"small":  64,
+	"medium": 256,
+	"large":  512,
+}
+
+// photoTypes are the image formats accepted for upload, as detected from the content rather than the file name
+var photoTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/webp": true,
+}
+
+// photoIDPattern matches the random IDs given to photos, which are also their file names
+var photoIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// errPhotoNotFound is returned by a photo storage when a photo does not exist
+var errPhotoNotFound = errors.New("photo not found")
+
+// PhotoStorage stores the encoded thumbnails of profile photos
+type PhotoStorage interface {
+	Save(key string, data []byte) error
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// photoStorage is the storage used by the user service
+var photoStorage PhotoStorage
+
+// LocalPhotoStorage stores photos as files in a folder on the local file system
+type LocalPhotoStorage struct {
+	Dir string
+}
+
+// Save writes the photo to a temporary file first, so that a photo is never served half written
+func (s LocalPhotoStorage) Save(key string, data []byte) error {
+	file, err := os.CreateTemp(s.Dir, "upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filepath.Join(s.Dir, key))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// Open opens the file of a photo
+func (s LocalPhotoStorage) Open(key string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(s.Dir, key))
+	if os.IsNotExist(err) {
+		return nil, errPhotoNotFound
+	}
+	return file, err
+}
+
+// Delete removes the file of a photo, photos that are already gone are ignored
+func (s LocalPhotoStorage) Delete(key string) error {
+	err := os.Remove(filepath.Join(s.Dir, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// loadPhotoConfig sets up the local photo storage in PHOTO_DIR
+func loadPhotoConfig() {
+	dir := os.Getenv("PHOTO_DIR")
+	if dir == "" {
+		dir = "photos"
+	}
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		log.Fatal(err)
+	}
+	photoStorage = LocalPhotoStorage{Dir: dir}
+}
+
+// photoKey returns the storage key of one thumbnail of a photo
+func photoKey(photoID, size string) string {
+	return photoID + "-" + size + ".jpg"
+}
+
+// photoURLs returns the address of each thumbnail of a photo, or nil when the user has no photo
+func photoURLs(photoID sql.NullString) map[string]string {
+	if !photoID.Valid {
+		return nil
+	}
+	urls := map[string]string{}
+	for size := range photoSizes {
+		urls[size] = publicURL() + "/api/v1/photos/" + photoID.String + "/" + size
+	}
+	return urls
+}
+
+// deletePhotoFiles removes every thumbnail of a photo
+func deletePhotoFiles(photoID string) {
+	for size := range photoSizes {
+		if err := photoStorage.Delete(photoKey(photoID, size)); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// thumbnail crops the middle square of an image and scales it to the given side length.
+// Transparent areas are filled with white, as JPEG has no transparency.
+func thumbnail(src image.Image, side int) image.Image {
+	bounds := src.Bounds()
+	square := bounds.Dx()
+	if bounds.Dy() < square {
+		square = bounds.Dy()
+	}
+	crop := image.Rect(0, 0, square, square).Add(image.Pt(
+		bounds.Min.X+(bounds.Dx()-square)/2,
+		bounds.Min.Y+(bounds.Dy()-square)/2,
+	))
+
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Over, nil)
+	return dst
+}
+
+// readPhoto reads the uploaded photo and checks its size, format and dimensions.
+// It returns the HTTP status to answer with when the photo is not accepted.
+func readPhoto(w http.ResponseWriter, r *http.Request) (image.Image, int, error) {
+	// Leave some room for the rest of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, maxPhotoSize+64<<10)
+	file, _, err := r.FormFile("photo")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("photo must be at most %d MB", maxPhotoSize>>20)
+		}
+		return nil, http.StatusBadRequest, errors.New("a multipart form with the image in the photo field is required")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxPhotoSize+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if len(data) > maxPhotoSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("photo must be at most %d MB", maxPhotoSize>>20)
+	}
+
+	// Trust the content of the file, not its name or the declared type
+	if contentType := http.DetectContentType(data); !photoTypes[contentType] {
+		return nil, http.StatusUnsupportedMediaType, errors.New("photo must be a JPEG, PNG or WebP image")
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("photo could not be read as an image")
+	}
+	if config.Width*config.Height > maxPhotoPixels {
+		return nil, http.StatusRequestEntityTooLarge, errors.New("photo has too many pixels")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("photo could not be read as an image")
+	}
+	return img, http.StatusOK, nil
+}
+
+// uploadPhoto replaces the profile photo of a user with the image in the photo field of a multipart form.
+// Only re-encoded thumbnails are kept, which also strips metadata such as the location of the camera.
+func uploadPhoto(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, _ := strconv.Atoi(params["userID"])
+
+	img, status, err := readPhoto(w, r)
+	if err != nil {
+		jsonResponse(w, status, map[string]interface{}{"Message": err.Error()})
+		return
+	}
+
+	// Store the thumbnails under a new random ID, so that cached copies of the old photo are never served for the new one
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	photoID := hex.EncodeToString(buf)
+	for size, side := range photoSizes {
+		var encoded bytes.Buffer
+		err := jpeg.Encode(&encoded, thumbnail(img, side), &jpeg.Options{Quality: 85})
+		if err == nil {
+			err = photoStorage.Save(photoKey(photoID, size), encoded.Bytes())
+		}
+		if err != nil {
+			fmt.Println(err)
+			deletePhotoFiles(photoID)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+	}
+
+	// Point the account at the new photo
+	previous, err := setPhoto(r, userID, sql.NullString{String: photoID, Valid: true})
+	if err != nil {
+		deletePhotoFiles(photoID)
+		if err == errUserNotFound {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if previous.Valid {
+		deletePhotoFiles(previous.String)
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"Message":   "Profile photo updated",
+		"PhotoURLs": photoURLs(sql.NullString{String: photoID, Valid: true}),
+	})
+}
+
+// deletePhoto removes the profile photo of a user
+func deletePhoto(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, _ := strconv.Atoi(params["userID"])
+
+	previous, err := setPhoto(r, userID, sql.NullString{})
+	if err != nil {
+		if err == errUserNotFound {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if !previous.Valid {
+		jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "No profile photo"})
+		return
+	}
+	deletePhotoFiles(previous.String)
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Profile photo removed"})
+}
+
+// setPhoto changes the photo of an active account and records it in the history, it returns the previous photo
+func setPhoto(r *http.Request, userID int, photoID sql.NullString) (sql.NullString, error) {
+	var previous sql.NullString
+	tx, err := db.Begin()
+	if err != nil {
+		return previous, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow("SELECT PhotoID FROM CarPoolUser WHERE UserID = ? AND DeletionDate IS NULL FOR UPDATE", userID).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return previous, errUserNotFound
+	}
+	if err != nil {
+		return previous, err
+	}
+	if !previous.Valid && !photoID.Valid {
+		return previous, nil
+	}
+
+	_, err = tx.Exec("UPDATE CarPoolUser SET PhotoID = ?, LastUpdate = ? WHERE UserID = ?", photoID, time.Now().Format(dateTimeLayout), userID)
+	if err == nil {
+		err = recordHistory(tx, r, userID, historyPhotoChanged, []FieldChange{{"PhotoID", previous, photoID}})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	return previous, err
+}
+
+// servePhoto serves one thumbnail of a profile photo, photos are public so that they can be shown next to trips
+func servePhoto(w http.ResponseWriter, r *http.Request) {
+	// Get the photo ID and size from the request parameters
+	params := mux.Vars(r)
+	photoID, size := params["photoID"], params["size"]
+	if _, found := photoSizes[size]; !found || !photoIDPattern.MatchString(photoID) {
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := photoStorage.Open(photoKey(photoID, size))
+	if err != nil {
+		if err != errPhotoNotFound {
+			fmt.Println(err)
+		}
+		http.Error(w, "Photo not found", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	// A photo ID always refers to the same image, so it can be cached for good
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err := io.Copy(w, file); err != nil {
+		fmt.Println(err)
+	}
+}
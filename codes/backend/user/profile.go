@@ -0,0 +1,332 @@
+// profile.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// userColumns lists the CarPoolUser columns scanned by scanUser
+const userColumns = "UserID, FirstName, LastName, MobileNumber, EmailAddress, UserPassword, DriverLicense, CarPlateNumber, CreationDate, LastUpdate, DeletionDate, UserType, EmailVerifiedDate, SuspendedDate, SuspensionReason, PhotoID"
+
+// readOnlyUserFields are the fields a profile update may not set, with the reason returned to the client
+var readOnlyUserFields = map[string]string{
+	"UserID":         "is immutable",
+	"CreationDate":   "is immutable",
+	"LastUpdate":     "is set by the server",
+	"DeletionDate":   "can only be set with DELETE /api/v1/users/{userID}",
+	"UserPassword":   "can only be changed with PUT /api/v1/users/{userID}/password",
+	"DriverLicense":  "can only be changed by applying with POST /api/v1/users/{userID}/upgrade",
+	"CarPlateNumber": "can only be changed by applying with POST /api/v1/users/{userID}/upgrade",
+}
+
+// errUserNotFound is returned by loadUser when no account has the given ID
+var errUserNotFound = errors.New("user not found")
+
+// scanUser scans a row selected with userColumns
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var user User
+	err := row.Scan(&user.UserID, &user.FirstName, &user.LastName, &user.MobileNumber,
+		&user.EmailAddress, &user.UserPassword, &user.DriverLicense,
+		&user.CarPlateNumber, &user.CreationDate, &user.LastUpdate,
+		&user.DeletionDate, &user.UserType, &user.EmailVerifiedDate,
+		&user.SuspendedDate, &user.SuspensionReason, &user.PhotoID)
+	return user, err
+}
+
+// loadUser returns the account with the given ID
+func loadUser(userID interface{}) (User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM CarPoolUser WHERE UserID = ?", userID))
+	if err == sql.ErrNoRows {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+// checkProfileChange validates an updated profile against the current one.
+// The car details are read-only, new ones are reviewed through a car owner application.
+// It returns the HTTP status to answer with when the change is not allowed.
+func checkProfileChange(current User, updated *User, callerRole string) (int, error) {
+	// Role changes go through the upgrade and downgrade workflow, only admins can assign roles directly
+	if current.UserType != updated.UserType && !can(callerRole, actionAssignRoles) {
+		return http.StatusForbidden, errors.New("use the upgrade or downgrade endpoints to change your account type")
+	}
+
+	// Car owners are only made by approving an application, so that their car details are always reviewed
+	if updated.UserType == roleCarOwner && current.UserType != roleCarOwner {
+		return http.StatusForbidden, errors.New("approve a car owner application with POST /api/v1/admin/upgrades/{applicationID}/approve to make a user a car owner")
+	}
+
+	// Sending the current car details back is allowed, changing them is not
+	license := normalizeIdentifier(updated.DriverLicense.String)
+	plate := normalizeIdentifier(updated.CarPlateNumber.String)
+	if (updated.DriverLicense.Valid && license != current.DriverLicense.String) || (updated.CarPlateNumber.Valid && plate != current.CarPlateNumber.String) {
+		return http.StatusForbidden, errors.New("DriverLicense and CarPlateNumber can only be changed by applying with POST /api/v1/users/{userID}/upgrade")
+	}
+	updated.DriverLicense, updated.CarPlateNumber = current.DriverLicense, current.CarPlateNumber
+
+	// Accounts that stop being car owners lose their car details
+	if updated.UserType != roleCarOwner {
+		updated.DriverLicense, updated.CarPlateNumber = sql.NullString{}, sql.NullString{}
+	}
+
+	// Only car owners fill in the car owner fields
+	if err := checkRoleFields(*updated); err != nil {
+		return http.StatusBadRequest, err
+	}
+	return http.StatusOK, nil
+}
+
+// saveProfile writes the editable profile fields of a user, stamps LastUpdate and records the changed fields.
+// A new email address has to be verified again.
+func saveProfile(r *http.Request, current, user User) error {
+	emailChanged := current.EmailAddress != user.EmailAddress
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE CarPoolUser SET FirstName=?, LastName=?, MobileNumber=?, EmailAddress=?, DriverLicense=?, CarPlateNumber=?, UserType=?, LastUpdate=?, EmailVerifiedDate=IF(?, NULL, EmailVerifiedDate) WHERE UserID=?",
+		user.FirstName, user.LastName, user.MobileNumber, user.EmailAddress, user.DriverLicense, user.CarPlateNumber, user.UserType, time.Now().Format(dateTimeLayout), emailChanged, user.UserID,
+	)
+	if err != nil {
+		return err
+	}
+	if err := recordHistory(tx, r, user.UserID, historyProfileUpdated, profileChanges(current, user)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if emailChanged {
+		if err := sendVerificationEmail(user.UserID, user.EmailAddress, user.FirstName); err != nil {
+			fmt.Println(err)
+		}
+	}
+	return nil
+}
+
+// patchUser handles partial updates of user accounts, only the fields present in the body are changed
+func patchUser(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	// Decode the request body field by field, so that absent fields can be told apart from empty ones
+	var patch map[string]json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reject fields that cannot be changed through a profile edit
+	var rejected []string
+	for field := range patch {
+		if reason, found := readOnlyUserFields[field]; found {
+			rejected = append(rejected, field+" "+reason)
+		}
+	}
+	if len(rejected) > 0 {
+		sort.Strings(rejected)
+		http.Error(w, strings.Join(rejected, "; "), http.StatusBadRequest)
+		return
+	}
+
+	// Load the current profile
+	current, err := loadUser(userID)
+	if err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		fmt.Println(err)
+		return
+	}
+
+	// Apply the fields that are present on top of the current profile
+	updated := current
+	for field, value := range patch {
+		var target interface{}
+		switch field {
+		case "FirstName":
+			target = &updated.FirstName
+		case "LastName":
+			target = &updated.LastName
+		case "MobileNumber":
+			target = &updated.MobileNumber
+		case "EmailAddress":
+			target = &updated.EmailAddress
+		case "UserType":
+			target = &updated.UserType
+		default:
+			http.Error(w, "Unknown field "+field, http.StatusBadRequest)
+			return
+		}
+		if err := decodePatchValue(value, target); err != nil {
+			http.Error(w, field+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Validate the result as a whole
+	normalizeProfile(&updated)
+	if errs := validateProfileChange(current, updated); len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, "Validation failed", errs)
+		return
+	}
+	if status, err := checkProfileChange(current, &updated, claimsFromContext(r).UserType); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if checkUniqueProfile(w, updated) {
+		return
+	}
+
+	// Update the user in the database
+	if err := saveProfile(r, current, updated); err != nil {
+		if errs := duplicateFieldErrors(err); errs != nil {
+			writeFieldErrors(w, http.StatusConflict, "Account details already in use", errs)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		return
+	}
+
+	// Return the stored profile
+	saved, err := loadUser(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		return
+	}
+	jsonResponse(w, http.StatusOK, newUserResponse(saved))
+}
+
+// decodePatchValue decodes a JSON value into a string, or into a nullable string that accepts a plain string or null
+func decodePatchValue(value json.RawMessage, target interface{}) error {
+	switch target := target.(type) {
+	case *sql.NullString:
+		var text *string
+		if err := json.Unmarshal(value, &text); err != nil {
+			return errors.New("expected a string or null")
+		}
+		*target = sql.NullString{}
+		if text != nil && *text != "" {
+			*target = sql.NullString{String: *text, Valid: true}
+		}
+		return nil
+	default:
+		if string(value) == "null" {
+			return errors.New("cannot be null")
+		}
+		if err := json.Unmarshal(value, target); err != nil {
+			return errors.New("expected a string")
+		}
+		return nil
+	}
+}
+
+// changePassword changes the password of a user after checking the current one
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	// Decode the request body into a struct
+	var body struct {
+		CurrentPassword string `json:"CurrentPassword"`
+		NewPassword     string `json:"NewPassword"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.CurrentPassword == "" || body.NewPassword == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "CurrentPassword and NewPassword are required"})
+		return
+	}
+
+	// Check the current password, wrong ones count towards the same throttle as failed logins
+	id, _ := strconv.Atoi(userID)
+	keys, ok := reauthThrottleKeys(w, r, id, time.Now())
+	if !ok {
+		return
+	}
+	var storedPassword string
+	err = db.QueryRow("SELECT UserPassword FROM CarPoolUser WHERE UserID = ? AND DeletionDate IS NULL", userID).Scan(&storedPassword)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if match, _ := checkPassword(storedPassword, body.CurrentPassword); !match {
+		if err := recordLoginFailure(keys, sql.NullInt64{Int64: int64(id), Valid: true}, time.Now()); err != nil {
+			fmt.Println(err)
+		}
+		jsonResponse(w, http.StatusForbidden, map[string]interface{}{"Message": "Current password is incorrect"})
+		return
+	}
+	if err := recordLoginSuccess(keys); err != nil {
+		fmt.Println(err)
+	}
+
+	// Store the hash of the new password, which has to follow the password policy
+	if reason := validatePassword(body.NewPassword); reason != "" {
+		writeFieldErrors(w, http.StatusBadRequest, "Validation failed", FieldErrors{"NewPassword": reason})
+		return
+	}
+	hashed, err := hashPassword(body.NewPassword)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": err.Error()})
+		return
+	}
+	now := time.Now().Format(dateTimeLayout)
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE CarPoolUser SET UserPassword = ?, LastUpdate = ? WHERE UserID = ?", hashed, now, userID)
+	if err == nil {
+		err = recordHistory(tx, r, id, historyPasswordChanged, []FieldChange{{"UserPassword", textValue(storedPassword), textValue(hashed)}})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Log out every other device, the session making the change stays signed in
+	_, err = db.Exec(
+		"UPDATE CarPoolSession SET RevocationDate = ? WHERE UserID = ? AND SessionID <> ? AND RevocationDate IS NULL",
+		now, userID, claimsFromContext(r).ID,
+	)
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Password changed"})
+}
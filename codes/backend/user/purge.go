@@ -0,0 +1,140 @@
+// purge.go
+
+package main
+
+// import all the necessary packages
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// defaultPurgeInterval is how often the purge worker looks for accounts past their retention period
+const defaultPurgeInterval = time.Hour
+
+// startPurgeWorker runs purgeDeletedUsers and expireDataExports in the background, at the interval set by PURGE_INTERVAL (e.g. "30m")
+func startPurgeWorker() {
+	interval := defaultPurgeInterval
+	if value := os.Getenv("PURGE_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Fatalf("invalid PURGE_INTERVAL %q", value)
+		}
+		interval = parsed
+	}
+
+	go func() {
+		for {
+			purged, err := purgeDeletedUsers(time.Now())
+			if err != nil {
+				fmt.Println("purge:", err)
+			} else if purged > 0 {
+				fmt.Println("purge: anonymised", purged, "deleted accounts")
+			}
+			if err := expireDataExports(time.Now()); err != nil {
+				fmt.Println("purge:", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// purgeDeletedUsers anonymises the accounts that were deleted more than a year before now.
+// The CarPoolUser rows are kept, so trips and bookings that reference them stay valid.
+func purgeDeletedUsers(now time.Time) (int64, error) {
+	cutoff := now.AddDate(-1, 0, 0).Format(dateTimeLayout)
+
+	// Remove the sessions, one-time tokens and two-factor secrets of the accounts that are about to be purged
+	for _, table := range []string{"CarPoolSession", "CarPoolUserToken", "CarPoolTwoFactor", "CarPoolRecoveryCode"} {
+		_, err := db.Exec(`
+			DELETE t FROM `+table+` t
+			JOIN CarPoolUser u ON t.UserID = u.UserID
+			WHERE u.DeletionDate IS NOT NULL AND u.DeletionDate <= ? AND u.PurgeDate IS NULL`, cutoff)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Forget the login failures and lockouts recorded under their email addresses
+	_, err := db.Exec(`
+		DELETE t FROM CarPoolLoginThrottle t
+		JOIN CarPoolUser u ON t.KeyType = 'account' AND t.KeyValue = u.EmailAddress
+		WHERE u.DeletionDate IS NOT NULL AND u.DeletionDate <= ? AND u.PurgeDate IS NULL`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.Exec(`
+		UPDATE CarPoolLockout l
+		JOIN CarPoolUser u ON l.KeyType = 'account' AND l.KeyValue = u.EmailAddress
+		SET l.KeyValue = CONCAT('deleted-', u.UserID, '@invalid')
+		WHERE u.DeletionDate IS NOT NULL AND u.DeletionDate <= ? AND u.PurgeDate IS NULL`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	// Keep what changed and when in the history, but not the values or where the change came from
+	_, err = db.Exec(`
+		UPDATE CarPoolUserHistory h
+		JOIN CarPoolUser u ON h.UserID = u.UserID
+		SET h.OldValue = IF(h.OldValue IS NULL, NULL, '[purged]'), h.NewValue = IF(h.NewValue IS NULL, NULL, '[purged]'), h.IPAddress = NULL
+		WHERE u.DeletionDate IS NOT NULL AND u.DeletionDate <= ? AND u.PurgeDate IS NULL`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	// Car owner applications keep the NRIC and car plate, which are replaced like the ones on the account
+	_, err = db.Exec(`
+		UPDATE CarPoolOwnerApplication a
+		JOIN CarPoolUser u ON a.UserID = u.UserID
+		SET a.DriverLicense = '[purged]', a.CarPlateNumber = '[purged]', a.ReviewNote = NULL
+		WHERE u.DeletionDate IS NOT NULL AND u.DeletionDate <= ? AND u.PurgeDate IS NULL`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	// Car plates identify their owner too
+	_, err = db.Exec(`
+		UPDATE CarPoolVehicle v
+		JOIN CarPoolUser u ON v.UserID = u.UserID
+		SET v.CarPlateNumber = CONCAT('deleted-', v.VehicleID), v.RetiredDate = IFNULL(v.RetiredDate, ?)
+		WHERE u.DeletionDate IS NOT NULL AND u.DeletionDate <= ? AND u.PurgeDate IS NULL`, now.Format(dateTimeLayout), cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	// Photos show the face of the user, so remove them from the storage
+	rows, err := db.Query("SELECT PhotoID FROM CarPoolUser WHERE DeletionDate IS NOT NULL AND DeletionDate <= ? AND PurgeDate IS NULL AND PhotoID IS NOT NULL", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	var photoIDs []string
+	for rows.Next() {
+		var photoID string
+		if err := rows.Scan(&photoID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		photoIDs = append(photoIDs, photoID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, photoID := range photoIDs {
+		deletePhotoFiles(photoID)
+	}
+
+	// Replace the personal data with placeholders, the email address and mobile number stay unique per account
+	result, err := db.Exec(`
+		UPDATE CarPoolUser SET
+			FirstName = 'Deleted', LastName = 'User', MobileNumber = CONCAT('deleted-', UserID),
+			EmailAddress = CONCAT('deleted-', UserID, '@invalid'), UserPassword = '',
+			DriverLicense = NULL, CarPlateNumber = NULL, SuspensionReason = NULL, PhotoID = NULL, PurgeDate = ?
+		WHERE DeletionDate IS NOT NULL AND DeletionDate <= ? AND PurgeDate IS NULL`,
+		now.Format(dateTimeLayout), cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,164 @@
+// reset.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// passwordResetTTL is how long a password reset link stays valid
+const passwordResetTTL = time.Hour
+
+// passwordResetInterval is the minimum time between two reset emails to the same account
+const passwordResetInterval = time.Minute
+
+// requestPasswordReset emails a single-use reset link to the account with the given email address.
+// The response is the same whether or not the address is registered.
+func requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	// Decode the request body into a struct
+	var body struct {
+		EmailAddress string `json:"EmailAddress"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.EmailAddress == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "EmailAddress is required"})
+		return
+	}
+	accepted := map[string]interface{}{"Message": "If the email address is registered, a reset link has been sent to it"}
+
+	// Look up the active account with the address
+	var userID int
+	var firstName, emailAddress string
+	err = db.QueryRow("SELECT UserID, FirstName, EmailAddress FROM CarPoolUser WHERE EmailAddress = ? AND DeletionDate IS NULL", normalizeEmail(body.EmailAddress)).
+		Scan(&userID, &firstName, &emailAddress)
+	if err == sql.ErrNoRows {
+		jsonResponse(w, http.StatusAccepted, accepted)
+		return
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Do not flood the mailbox when the form is submitted repeatedly
+	var recent int
+	err = db.QueryRow(
+		"SELECT COUNT(*) FROM CarPoolUserToken WHERE UserID = ? AND Purpose = ? AND CreationDate > ?",
+		userID, purposePasswordReset, time.Now().Add(-passwordResetInterval).Format(dateTimeLayout),
+	).Scan(&recent)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if recent > 0 {
+		jsonResponse(w, http.StatusAccepted, accepted)
+		return
+	}
+
+	// Send the single-use link. The email is sent in the background, so that the time to answer does not tell
+	// registered addresses apart from unknown ones.
+	token, err := createUserToken(userID, purposePasswordReset, passwordResetTTL)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	link := frontendURL() + "/reset-password?token=" + url.QueryEscape(token)
+	mailBody := "Hi " + firstName + ",\n\n" +
+		"Someone asked to reset the password of your car-pooling account. Open this link within an hour to choose a new password:\n\n" +
+		link + "\n\n" +
+		"If it was not you, you can ignore this email, your password has not been changed."
+	go func() {
+		if err := mailer.Send(emailAddress, "Reset your password", mailBody); err != nil {
+			fmt.Println(err)
+		}
+	}()
+
+	jsonResponse(w, http.StatusAccepted, accepted)
+}
+
+// confirmPasswordReset sets a new password with a reset token and logs the account out of every session
+func confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	// Decode the request body into a struct
+	var body struct {
+		Token       string `json:"Token"`
+		NewPassword string `json:"NewPassword"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Token == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Token and NewPassword are required"})
+		return
+	}
+
+	// Apply the same password policy as registration
+	if reason := validatePassword(body.NewPassword); reason != "" {
+		writeFieldErrors(w, http.StatusBadRequest, "Validation failed", FieldErrors{"NewPassword": reason})
+		return
+	}
+	hashed, err := hashPassword(body.NewPassword)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Use up the token and change the password together
+	userID, err := consumeUserToken(tx, body.Token, purposePasswordReset)
+	if err != nil {
+		if err == errInvalidUserToken {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid or expired reset link"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+
+	// Opening the link also proves that the email address is reachable
+	now := time.Now().Format(dateTimeLayout)
+	result, err := tx.Exec(
+		"UPDATE CarPoolUser SET UserPassword = ?, LastUpdate = ?, EmailVerifiedDate = IFNULL(EmailVerifiedDate, ?) WHERE UserID = ? AND DeletionDate IS NULL",
+		hashed, now, now, userID,
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid or expired reset link"})
+		return
+	}
+	if err := recordHistory(tx, r, userID, historyPasswordReset, []FieldChange{{"UserPassword", textValue(redactedValue), textValue(hashed)}}); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Whoever knew the old password is logged out
+	if _, err := revokeAllSessions(userID); err != nil {
+		fmt.Println(err)
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Password has been reset, please log in again"})
+}
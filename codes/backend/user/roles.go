@@ -0,0 +1,85 @@
+// roles.go
+
+package main
+
+// import all the necessary packages
+import (
+	"errors"
+	"net/http"
+)
+
+// Roles stored in CarPoolUser.UserType and carried by the access token
+const (
+	rolePassenger = "passenger"
+	roleCarOwner  = "car owner"
+	roleAdmin     = "admin"
+)
+
+// action is an operation of the user service that a role may or may not perform
+type action string
+
+// Actions of the user service
+const (
+	actionAccessAnyUser    action = "access any user"
+	actionAssignRoles      action = "assign roles"
+	actionApplyOwner       action = "apply to become a car owner"
+	actionDowngradeOwner   action = "downgrade to passenger"
+	actionReviewOwnerUsers action = "review car owner applications"
+	actionManageLockouts   action = "manage login lockouts"
+	actionManageUsers      action = "manage user accounts"
+	actionManageVehicles   action = "manage vehicles"
+)
+
+// rolePermissions maps each role to the actions it is allowed to perform beyond managing its own account
+var rolePermissions = map[string]map[action]bool{
+	rolePassenger: {
+		actionApplyOwner: true,
+	},
+	roleCarOwner: {
+		actionApplyOwner:     true,
+		actionDowngradeOwner: true,
+		actionManageVehicles: true,
+	},
+	roleAdmin: {
+		actionAccessAnyUser:    true,
+		actionAssignRoles:      true,
+		actionReviewOwnerUsers: true,
+		actionManageLockouts:   true,
+		actionManageUsers:      true,
+	},
+}
+
+// can reports whether a role is allowed to perform an action
+func can(role string, a action) bool {
+	return rolePermissions[role][a]
+}
+
+// requireAction rejects requests whose caller's role is not allowed to perform the action
+func requireAction(a action, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims := claimsFromContext(r)
+		if claims == nil || !can(claims.UserType, a) {
+			jsonResponse(w, http.StatusForbidden, map[string]interface{}{"Message": "Your account type is not allowed to " + string(a)})
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// checkRoleFields ensures that the car owner fields are filled in only, and always, for car owners
+func checkRoleFields(user User) error {
+	switch user.UserType {
+	case rolePassenger, roleAdmin:
+		if user.DriverLicense.String != "" || user.CarPlateNumber.String != "" {
+			return errors.New("only car owners can have a driver license or car plate number")
+		}
+	case roleCarOwner:
+		if user.DriverLicense.String == "" || user.CarPlateNumber.String == "" {
+			return errors.New("car owners must have a driver license and car plate number")
+		}
+	default:
+		return errors.New("unknown user type " + user.UserType)
+	}
+	return nil
+}
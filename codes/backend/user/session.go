@@ -0,0 +1,348 @@
+// session.go
+
+package main
+
+// import all the necessary packages
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// refreshTokenTTL is how long a session can be kept alive with its refresh token
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// lastSeenInterval limits how often the LastSeen column of a session is written
+const lastSeenInterval = time.Minute
+
+// Session represents a login of a user on one device
+type Session struct {
+	SessionID    int    `json:"SessionID"`
+	DeviceName   string `json:"DeviceName"`
+	IPAddress    string `json:"IPAddress"`
+	CreationDate string `json:"CreationDate"`
+	LastSeen     string `json:"LastSeen"`
+	ExpiryDate   string `json:"ExpiryDate"`
+	Current      bool   `json:"Current"`
+}
+
+// newSecretToken generates a random token, such as a refresh token, and the hash that is stored in the database
+func newSecretToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashSecretToken(token), nil
+}
+
+// hashSecretToken returns the SHA-256 hash of a token, so that a leaked table cannot be replayed
+func hashSecretToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// clientIP returns the IP address of the caller, trusting X-Forwarded-For only when TRUST_PROXY is set.
+// The proxy appends the address it received the request from, so the rightmost entry is the only one a client cannot forge.
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if values := r.Header.Values("X-Forwarded-For"); len(values) > 0 {
+			entries := strings.Split(values[len(values)-1], ",")
+			if last := strings.TrimSpace(entries[len(entries)-1]); last != "" {
+				return last
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// deviceName describes the device of the caller from its User-Agent header
+func deviceName(r *http.Request) string {
+	name := r.UserAgent()
+	if name == "" {
+		return "Unknown device"
+	}
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	return name
+}
+
+// createSession records a new login and returns the session ID and the refresh token of the session
+func createSession(userID int, r *http.Request) (int, string, error) {
+	refreshToken, refreshHash, err := newSecretToken()
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Store the session with the device and IP address it was created from
+	now := time.Now()
+	result, err := db.Exec(
+		"INSERT INTO CarPoolSession (UserID, RefreshTokenHash, DeviceName, IPAddress, CreationDate, LastSeen, ExpiryDate) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, refreshHash, deviceName(r), clientIP(r), now.Format(dateTimeLayout), now.Format(dateTimeLayout), now.Add(refreshTokenTTL).Format(dateTimeLayout),
+	)
+	if err != nil {
+		return 0, "", err
+	}
+
+	sessionID, err := result.LastInsertId()
+	if err != nil {
+		return 0, "", err
+	}
+	return int(sessionID), refreshToken, nil
+}
+
+// issueSessionTokens creates a session for the user and writes the access and refresh tokens to the response
+func issueSessionTokens(w http.ResponseWriter, r *http.Request, userID int, userType string, response map[string]interface{}) {
+	// Record the login
+	sessionID, refreshToken, err := createSession(userID, r)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Issue a signed access token bound to the session
+	accessToken, expiresAt, err := issueAccessToken(userID, userType, sessionID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	response["AccessToken"] = accessToken
+	response["TokenType"] = "Bearer"
+	response["ExpiresAt"] = expiresAt.Format(time.RFC3339)
+	response["RefreshToken"] = refreshToken
+	jsonResponse(w, http.StatusOK, response)
+}
+
+// sessionActive reports whether a session exists and has been neither revoked nor expired, and refreshes its LastSeen.
+// The role of the token is replaced by the one stored for the user, so that a role change applies before the token expires.
+func sessionActive(claims *TokenClaims) (bool, error) {
+	now := time.Now()
+	var userType string
+	err := db.QueryRow(`
+		SELECT u.UserType FROM CarPoolSession s
+		JOIN CarPoolUser u ON s.UserID = u.UserID
+		WHERE s.SessionID = ? AND s.UserID = ? AND s.RevocationDate IS NULL AND s.ExpiryDate > ?
+			AND u.DeletionDate IS NULL AND u.SuspendedDate IS NULL`,
+		claims.ID, claims.Subject, now.Format(dateTimeLayout),
+	).Scan(&userType)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	claims.UserType = userType
+
+	// Only write LastSeen once per interval to keep authenticated reads cheap
+	_, err = db.Exec(
+		"UPDATE CarPoolSession SET LastSeen = ? WHERE SessionID = ? AND LastSeen < ?",
+		now.Format(dateTimeLayout), claims.ID, now.Add(-lastSeenInterval).Format(dateTimeLayout),
+	)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return true, nil
+}
+
+// revokeAllSessions revokes every active session of a user and returns the number of sessions revoked
+func revokeAllSessions(userID int) (int64, error) {
+	result, err := db.Exec(
+		"UPDATE CarPoolSession SET RevocationDate = ? WHERE UserID = ? AND RevocationDate IS NULL",
+		time.Now().Format(dateTimeLayout), userID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// refreshSession exchanges a refresh token for a new access token and a new refresh token
+func refreshSession(w http.ResponseWriter, r *http.Request) {
+	// Decode the request body into a struct
+	var body struct {
+		RefreshToken string `json:"RefreshToken"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.RefreshToken == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "RefreshToken is required"})
+		return
+	}
+
+	// Look up the active session that owns the refresh token
+	now := time.Now()
+	var sessionID, userID int
+	var userType string
+	err = db.QueryRow(`
+		SELECT s.SessionID, u.UserID, u.UserType
+		FROM CarPoolSession s
+		JOIN CarPoolUser u ON s.UserID = u.UserID
+		WHERE s.RefreshTokenHash = ? AND s.RevocationDate IS NULL AND s.ExpiryDate > ? AND u.DeletionDate IS NULL AND u.SuspendedDate IS NULL`,
+		hashSecretToken(body.RefreshToken), now.Format(dateTimeLayout),
+	).Scan(&sessionID, &userID, &userType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid or expired refresh token"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+
+	// Rotate the refresh token so that each one can only be used once
+	refreshToken, refreshHash, err := newSecretToken()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	result, err := db.Exec(
+		"UPDATE CarPoolSession SET RefreshTokenHash = ?, IPAddress = ?, LastSeen = ? WHERE SessionID = ? AND RefreshTokenHash = ?",
+		refreshHash, clientIP(r), now.Format(dateTimeLayout), sessionID, hashSecretToken(body.RefreshToken),
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Another request rotated the same token first
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid or expired refresh token"})
+		return
+	}
+
+	// Issue a new access token for the same session
+	accessToken, expiresAt, err := issueAccessToken(userID, userType, sessionID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"AccessToken":  accessToken,
+		"TokenType":    "Bearer",
+		"ExpiresAt":    expiresAt.Format(time.RFC3339),
+		"RefreshToken": refreshToken,
+	})
+}
+
+// logoutUser revokes the session of the access token used for the request
+func logoutUser(w http.ResponseWriter, r *http.Request) {
+	claims := claimsFromContext(r)
+
+	_, err := db.Exec(
+		"UPDATE CarPoolSession SET RevocationDate = ? WHERE SessionID = ? AND UserID = ? AND RevocationDate IS NULL",
+		time.Now().Format(dateTimeLayout), claims.ID, claims.Subject,
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Logged out successfully"})
+}
+
+// getUserSessions lists the active sessions of a user
+func getUserSessions(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	// Query the database for the sessions that have not been revoked or expired
+	rows, err := db.Query(
+		"SELECT SessionID, DeviceName, IPAddress, CreationDate, LastSeen, ExpiryDate FROM CarPoolSession WHERE UserID = ? AND RevocationDate IS NULL AND ExpiryDate > ? ORDER BY LastSeen DESC",
+		userID, time.Now().Format(dateTimeLayout),
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	// Add the data into the struct, flagging the session of the caller
+	currentSessionID := claimsFromContext(r).ID
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.SessionID, &session.DeviceName, &session.IPAddress, &session.CreationDate, &session.LastSeen, &session.ExpiryDate)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		session.Current = strconv.Itoa(session.SessionID) == currentSessionID
+		sessions = append(sessions, session)
+	}
+
+	jsonResponse(w, http.StatusOK, sessions)
+}
+
+// revokeUserSession revokes one session of a user, for example on a lost device
+func revokeUserSession(w http.ResponseWriter, r *http.Request) {
+	// Get the user and session IDs from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+	sessionID := params["sessionID"]
+
+	result, err := db.Exec(
+		"UPDATE CarPoolSession SET RevocationDate = ? WHERE SessionID = ? AND UserID = ? AND RevocationDate IS NULL",
+		time.Now().Format(dateTimeLayout), sessionID, userID,
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Only sessions of the same user that are still active can be revoked
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Session not found"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Session revoked"})
+}
+
+// revokeUserSessions revokes every session of a user, including the one making the request
+func revokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userID"])
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid user ID"})
+		return
+	}
+
+	revoked, err := revokeAllSessions(userID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Sessions revoked", "Revoked": revoked})
+}
@@ -0,0 +1,82 @@
+// token.go
+
+package main
+
+// import all the necessary packages
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// tokenIssuer identifies the user service as the issuer of access tokens
+const tokenIssuer = "carpool-user-service"
+
+// accessTokenTTL is how long an access token stays valid after it is issued
+const accessTokenTTL = 15 * time.Minute
+
+// tokenSecret is the HMAC key shared with the trip service, read from the JWT_SECRET environment variable
+var tokenSecret []byte
+
+// TokenClaims represents the claims carried by an access token
+type TokenClaims struct {
+	UserType string `json:"UserType"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the user ID stored in the token subject
+func (c *TokenClaims) UserID() (int, error) {
+	return strconv.Atoi(c.Subject)
+}
+
+// loadTokenConfig reads the token signing key from the environment
+func loadTokenConfig() {
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) < 32 {
+		log.Fatal("JWT_SECRET must be set to a random string of at least 32 characters")
+	}
+	tokenSecret = []byte(secret)
+}
+
+// issueAccessToken signs a new access token for the given user and session and returns it with its expiry time
+func issueAccessToken(userID int, userType string, sessionID int) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+	claims := TokenClaims{
+		UserType: userType,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        strconv.Itoa(sessionID),
+			Issuer:    tokenIssuer,
+			Subject:   strconv.Itoa(userID),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(tokenSecret)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return signed, expiresAt, nil
+}
+
+// parseAccessToken verifies the signature and expiry of an access token and returns its claims
+func parseAccessToken(tokenString string) (*TokenClaims, error) {
+	var claims TokenClaims
+	_, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		return tokenSecret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(tokenIssuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+
+	// Every token issued by the user service carries a numeric subject
+	if _, err := claims.UserID(); err != nil {
+		return nil, errors.New("token subject is not a user ID")
+	}
+	return &claims, nil
+}
@@ -0,0 +1,611 @@
+// twofactor.go
+
+package main
+
+// import all the necessary packages
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Settings of the time-based one-time passwords (RFC 6238), the defaults understood by every authenticator app
+const (
+	totpIssuer = "ETI CarPool"
+	totpPeriod = 30 // seconds per time step
+	totpDigits = 6
+	totpSkew   = 1 // time steps accepted before and after the current one, for clock drift
+)
+
+// recoveryCodeCount is how many single-use recovery codes are issued at a time
+const recoveryCodeCount = 10
+
+// twoFactorChallengeTTL is how long the second step of a login may take after the password was accepted
+const twoFactorChallengeTTL = 5 * time.Minute
+
+// purposeTwoFactorLogin is the one-time token that links the two steps of a login
+const purposeTwoFactorLogin = "two-factor login"
+
+// totpEncoding is the base32 alphabet of TOTP secrets, without padding as authenticator apps expect
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateTOTPSecret returns a new random 160-bit secret encoded in base32
+func generateTOTPSecret() (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(buf), nil
+}
+
+// totpCode computes the code of a secret for a time step (HOTP with the step as counter, RFC 4226)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation of the HMAC to a number of totpDigits digits
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo), nil
+}
+
+// matchTOTP checks a code against the time steps around now and returns the step it matched.
+// Steps up to lastStep were already used and are refused, so that a code cannot be replayed.
+func matchTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// provisioningURI returns the otpauth:// URI that authenticator apps read from a QR code
+func provisioningURI(secret, accountName string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", strconv.Itoa(totpDigits))
+	query.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+accountName) + "?" + query.Encode()
+}
+
+// isTOTPCode reports whether a code looks like a one-time password rather than a recovery code
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRecoveryCode removes the separators and case differences a user may type
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// replaceRecoveryCodes discards the recovery codes of the user and returns a new set, only their hashes are stored
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	_, err := tx.Exec("DELETE FROM CarPoolRecoveryCode WHERE UserID = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	now := time.Now().Format(dateTimeLayout)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 10)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		code := totpEncoding.EncodeToString(buf)
+		_, err = tx.Exec("INSERT INTO CarPoolRecoveryCode (UserID, CodeHash, CreationDate) VALUES (?, ?, ?)", userID, hashSecretToken(code), now)
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[0:4]+"-"+code[4:8]+"-"+code[8:12]+"-"+code[12:16])
+	}
+	return codes, nil
+}
+
+// twoFactorEnabled reports whether the user has confirmed a two-factor enrolment
+func twoFactorEnabled(userID int) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM CarPoolTwoFactor WHERE UserID = ? AND EnabledDate IS NOT NULL", userID).Scan(&count)
+	return count > 0, err
+}
+
+// checkSecondFactor checks a one-time password or recovery code of a user with two-factor authentication enabled,
+// and uses it up inside the transaction
+func checkSecondFactor(tx *sql.Tx, userID int, code string, now time.Time) (bool, error) {
+	var secret string
+	var lastStep int64
+	err := tx.QueryRow("SELECT Secret, LastUsedStep FROM CarPoolTwoFactor WHERE UserID = ? AND EnabledDate IS NOT NULL FOR UPDATE", userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	code = strings.TrimSpace(code)
+	if isTOTPCode(code) {
+		step, ok := matchTOTP(secret, code, now, lastStep)
+		if !ok {
+			return false, nil
+		}
+		_, err = tx.Exec("UPDATE CarPoolTwoFactor SET LastUsedStep = ? WHERE UserID = ?", step, userID)
+		return err == nil, err
+	}
+
+	// Anything else is tried as a recovery code, each of which works once
+	result, err := tx.Exec(
+		"UPDATE CarPoolRecoveryCode SET UsedDate = ? WHERE UserID = ? AND CodeHash = ? AND UsedDate IS NULL",
+		now.Format(dateTimeLayout), userID, hashSecretToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// startTwoFactorChallenge answers a login whose password was accepted with a challenge for the second factor
+func startTwoFactorChallenge(w http.ResponseWriter, userID int) {
+	token, err := createUserToken(userID, purposeTwoFactorLogin, twoFactorChallengeTTL)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"TwoFactorRequired": true,
+		"ChallengeToken":    token,
+		"Message":           "Two-factor authentication required",
+	})
+}
+
+// completeTwoFactorLogin finishes a login with the challenge token and a one-time password or recovery code
+func completeTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	// Decode the request body into a struct
+	var body struct {
+		ChallengeToken string `json:"ChallengeToken"`
+		Code           string `json:"Code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.ChallengeToken == "" || body.Code == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "ChallengeToken and Code are required"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The challenge is only used up when the code is right, so that a typo can be corrected
+	userID, err := consumeUserToken(tx, body.ChallengeToken, purposeTwoFactorLogin)
+	if err != nil {
+		if err == errInvalidUserToken {
+			jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid or expired login challenge, please log in again"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	user, err := loadUser(userID)
+	if err != nil || user.DeletionDate.Valid || user.SuspendedDate.Valid {
+		if err != nil && err != errUserNotFound {
+			fmt.Println(err)
+		}
+		jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid or expired login challenge, please log in again"})
+		return
+	}
+
+	// Wrong codes count towards the same throttle as wrong passwords
+	now := time.Now()
+	keys := loginThrottleKeys(user.EmailAddress, r)
+	wait, err := loginBlockedFor(keys, now)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if wait > 0 {
+		writeLoginBlocked(w, wait)
+		return
+	}
+
+	ok, err := checkSecondFactor(tx, userID, body.Code, now)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if !ok {
+		tx.Rollback()
+		if err := recordLoginFailure(keys, sql.NullInt64{Int64: int64(userID), Valid: true}, now); err != nil {
+			fmt.Println(err)
+		}
+		jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid code"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if err := recordLoginSuccess(keys); err != nil {
+		fmt.Println(err)
+	}
+
+	// Authentication successful, record the session and issue its tokens
+	response := map[string]interface{}{"UserID": userID, "UserType": user.UserType, "FirstName": user.FirstName, "EmailVerified": user.EmailVerifiedDate.Valid, "Message": "Authenticated successfully"}
+	issueSessionTokens(w, r, userID, user.UserType, response)
+}
+
+// getTwoFactor returns whether two-factor authentication is enabled and how many recovery codes are left
+func getTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	var enabledDate sql.NullString
+	err := db.QueryRow("SELECT EnabledDate FROM CarPoolTwoFactor WHERE UserID = ?", userID).Scan(&enabledDate)
+	if err != nil && err != sql.ErrNoRows {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	var codesLeft int
+	err = db.QueryRow("SELECT COUNT(*) FROM CarPoolRecoveryCode WHERE UserID = ? AND UsedDate IS NULL", userID).Scan(&codesLeft)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"Enabled":           enabledDate.Valid,
+		"EnabledDate":       fromNullString(enabledDate),
+		"RecoveryCodesLeft": codesLeft,
+	})
+}
+
+// enrolTwoFactor creates a new TOTP secret for the caller, it takes effect once confirmed with a code
+func enrolTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	// The authenticator has to be set up by the account holder, not on their behalf
+	if claimsFromContext(r).Subject != userID {
+		jsonResponse(w, http.StatusForbidden, map[string]interface{}{"Message": "Only the account holder can set up two-factor authentication"})
+		return
+	}
+
+	user, err := loadUser(userID)
+	if err != nil {
+		if err == errUserNotFound {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+
+	enabled, err := twoFactorEnabled(user.UserID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if enabled {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	// A new enrolment replaces one that was started but never confirmed
+	secret, err := generateTOTPSecret()
+	if err == nil {
+		_, err = db.Exec(
+			"REPLACE INTO CarPoolTwoFactor (UserID, Secret, CreationDate, EnabledDate, LastUsedStep) VALUES (?, ?, ?, NULL, 0)",
+			user.UserID, secret, time.Now().Format(dateTimeLayout),
+		)
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusCreated, map[string]interface{}{
+		"Secret":          secret,
+		"ProvisioningURI": provisioningURI(secret, user.EmailAddress),
+		"Message":         "Scan the QR code with an authenticator app, then confirm with a code from it",
+	})
+}
+
+// confirmTwoFactor enables two-factor authentication with a first code from the authenticator and returns the recovery codes
+func confirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, _ := strconv.Atoi(params["userID"])
+
+	// Decode the request body into a struct
+	var body struct {
+		Code string `json:"Code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Code == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Code is required"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var secret string
+	var enabledDate sql.NullString
+	err = tx.QueryRow("SELECT Secret, EnabledDate FROM CarPoolTwoFactor WHERE UserID = ? FOR UPDATE", userID).Scan(&secret, &enabledDate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Two-factor authentication has not been set up"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if enabledDate.Valid {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	now := time.Now()
+	step, ok := matchTOTP(secret, strings.TrimSpace(body.Code), now, 0)
+	if !ok {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid code, check the time on the device"})
+		return
+	}
+
+	// Enable it and hand out the recovery codes together
+	_, err = tx.Exec("UPDATE CarPoolTwoFactor SET EnabledDate = ?, LastUsedStep = ? WHERE UserID = ?", now.Format(dateTimeLayout), step, userID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err == nil {
+		err = recordHistory(tx, r, userID, historyTwoFactorEnabled, []FieldChange{{"TwoFactorEnabled", textValue("false"), textValue("true")}})
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"RecoveryCodes": codes,
+		"Message":       "Two-factor authentication enabled, store the recovery codes somewhere safe as they are only shown once",
+	})
+}
+
+// regenerateRecoveryCodes replaces the recovery codes of the caller after checking a current code
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, _ := strconv.Atoi(params["userID"])
+
+	// Decode the request body into a struct
+	var body struct {
+		Code string `json:"Code"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Code == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Code is required"})
+		return
+	}
+
+	// Wrong codes count towards the same throttle as failed logins
+	now := time.Now()
+	keys, ok := reauthThrottleKeys(w, r, userID, now)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	ok, err = checkSecondFactor(tx, userID, body.Code, now)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if !ok {
+		tx.Rollback()
+		if err := recordLoginFailure(keys, sql.NullInt64{Int64: int64(userID), Valid: true}, now); err != nil {
+			fmt.Println(err)
+		}
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid code, or two-factor authentication is not enabled"})
+		return
+	}
+	if err := recordLoginSuccess(keys); err != nil {
+		fmt.Println(err)
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{
+		"RecoveryCodes": codes,
+		"Message":       "New recovery codes issued, the previous ones no longer work",
+	})
+}
+
+// disableTwoFactor turns two-factor authentication off. The account holder confirms with their password and a code,
+// an admin can turn it off for a user who lost their authenticator.
+func disableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, _ := strconv.Atoi(params["userID"])
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if claimsFromContext(r).Subject == strconv.Itoa(userID) {
+		// Decode the request body into a struct
+		var body struct {
+			CurrentPassword string `json:"CurrentPassword"`
+			Code            string `json:"Code"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil || body.CurrentPassword == "" || body.Code == "" {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "CurrentPassword and Code are required"})
+			return
+		}
+
+		// Wrong passwords and codes count towards the same throttle as failed logins
+		now := time.Now()
+		keys, ok := reauthThrottleKeys(w, r, userID, now)
+		if !ok {
+			return
+		}
+		failed := func() {
+			tx.Rollback()
+			if err := recordLoginFailure(keys, sql.NullInt64{Int64: int64(userID), Valid: true}, now); err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		var storedPassword string
+		err = tx.QueryRow("SELECT UserPassword FROM CarPoolUser WHERE UserID = ?", userID).Scan(&storedPassword)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		if match, _ := checkPassword(storedPassword, body.CurrentPassword); !match {
+			failed()
+			jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Current password is incorrect"})
+			return
+		}
+
+		ok, err = checkSecondFactor(tx, userID, body.Code, now)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		if !ok {
+			failed()
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid code, or two-factor authentication is not enabled"})
+			return
+		}
+		if err := recordLoginSuccess(keys); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// Remove the secret and the recovery codes together
+	_, err = tx.Exec("DELETE FROM CarPoolRecoveryCode WHERE UserID = ?", userID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	result, err := tx.Exec("DELETE FROM CarPoolTwoFactor WHERE UserID = ?", userID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Two-factor authentication is not enabled"})
+		return
+	}
+	if err := recordHistory(tx, r, userID, historyTwoFactorRemoved, []FieldChange{{"TwoFactorEnabled", textValue("true"), textValue("false")}}); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Two-factor authentication disabled"})
+}
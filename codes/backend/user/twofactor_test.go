@@ -0,0 +1,81 @@
+// twofactor_test.go
+
+package main
+
+// import all the necessary packages
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 seed of the RFC 6238 test vectors, "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestTOTPCode checks the codes against the SHA-1 test vectors of RFC 6238, truncated to the last totpDigits digits
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		got, err := totpCode(rfc6238Secret, test.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode at %d: %v", test.unix, err)
+		}
+		if got != test.want {
+			t.Errorf("totpCode at %d = %s, want %s", test.unix, got, test.want)
+		}
+	}
+}
+
+// TestTOTPCodeInvalidSecret checks that a secret which is not base32 is refused
+func TestTOTPCodeInvalidSecret(t *testing.T) {
+	if _, err := totpCode("not base32!", 1); err == nil {
+		t.Error("totpCode accepted a secret that is not base32")
+	}
+}
+
+// TestMatchTOTP checks the clock drift allowed around the current step and the refusal of replayed codes
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / totpPeriod
+	tests := []struct {
+		name     string
+		step     int64
+		lastStep int64
+		wantOK   bool
+	}{
+		{"current step", current, 0, true},
+		{"previous step", current - totpSkew, 0, true},
+		{"next step", current + totpSkew, 0, true},
+		{"too old", current - totpSkew - 1, 0, false},
+		{"too new", current + totpSkew + 1, 0, false},
+		{"replayed", current, current, false},
+		{"after a used step", current, current - 1, true},
+	}
+	for _, test := range tests {
+		code, err := totpCode(rfc6238Secret, test.step)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		step, ok := matchTOTP(rfc6238Secret, code, now, test.lastStep)
+		if ok != test.wantOK {
+			t.Errorf("%s: matchTOTP ok = %v, want %v", test.name, ok, test.wantOK)
+		}
+		if ok && step != test.step {
+			t.Errorf("%s: matchTOTP step = %d, want %d", test.name, step, test.step)
+		}
+	}
+
+	// A wrong code matches no step
+	if _, ok := matchTOTP(rfc6238Secret, "000000", now, 0); ok {
+		t.Error("matchTOTP accepted a wrong code")
+	}
+}
@@ -0,0 +1,384 @@
+// upgrade.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Statuses of a car owner application
+const (
+	applicationPending  = "pending"
+	applicationApproved = "approved"
+	applicationRejected = "rejected"
+)
+
+// tripLocation is the time zone of the start times of trips, which the trip service stores in Singapore time
+var tripLocation = loadTripLocation()
+
+// loadTripLocation loads the Singapore time zone, falling back to its fixed offset when the zone database is missing
+func loadTripLocation() *time.Location {
+	location, err := time.LoadLocation("Asia/Singapore")
+	if err != nil {
+		return time.FixedZone("SGT", 8*60*60)
+	}
+	return location
+}
+
+// OwnerApplication represents a request of a passenger to become a car owner, or of a car owner to change their car details,
+// as stored in CarPoolOwnerApplication
+type OwnerApplication struct {
+	ApplicationID  int
+	UserID         int
+	DriverLicense  string
+	CarPlateNumber string
+	Status         string
+	SubmissionDate string
+	ReviewDate     sql.NullString
+	ReviewerID     sql.NullInt64
+	ReviewNote     sql.NullString
+}
+
+// ownerApplicationColumns lists the columns scanned by scanOwnerApplication
+const ownerApplicationColumns = "ApplicationID, UserID, DriverLicense, CarPlateNumber, Status, SubmissionDate, ReviewDate, ReviewerID, ReviewNote"
+
+// scanOwnerApplication scans a row selected with ownerApplicationColumns
+func scanOwnerApplication(row interface{ Scan(...interface{}) error }) (OwnerApplication, error) {
+	var application OwnerApplication
+	err := row.Scan(&application.ApplicationID, &application.UserID, &application.DriverLicense, &application.CarPlateNumber,
+		&application.Status, &application.SubmissionDate, &application.ReviewDate, &application.ReviewerID, &application.ReviewNote)
+	return application, err
+}
+
+// requestOwnerUpgrade submits a passenger's application to become a car owner, or a car owner's new car details, pending admin approval
+func requestOwnerUpgrade(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	// Decode the request body into a struct
+	var body struct {
+		DriverLicense  string `json:"DriverLicense"`
+		CarPlateNumber string `json:"CarPlateNumber"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": err.Error()})
+		return
+	}
+
+	// Validate the licence and plate formats, including their checksum letters
+	license := normalizeIdentifier(body.DriverLicense)
+	plate := normalizeIdentifier(body.CarPlateNumber)
+	if !isValidDriverLicense(license) {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "DriverLicense is not a valid NRIC or FIN"})
+		return
+	}
+	if !isValidCarPlate(plate) {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "CarPlateNumber is not a valid Singapore car plate"})
+		return
+	}
+
+	// Active passengers apply to become car owners, and car owners apply to change their car details
+	var userType string
+	var currentLicense, currentPlate sql.NullString
+	err = db.QueryRow("SELECT UserType, DriverLicense, CarPlateNumber FROM CarPoolUser WHERE UserID = ? AND DeletionDate IS NULL", userID).Scan(&userType, &currentLicense, &currentPlate)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if userType != rolePassenger && userType != roleCarOwner {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Only passengers and car owners can apply"})
+		return
+	}
+	if userType == roleCarOwner && license == currentLicense.String && plate == currentPlate.String {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "These are already your car details"})
+		return
+	}
+
+	// Only one application can be pending at a time
+	var pendingID int
+	err = db.QueryRow("SELECT ApplicationID FROM CarPoolOwnerApplication WHERE UserID = ? AND Status = ?", userID, applicationPending).Scan(&pendingID)
+	if err == nil {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "An application is already pending", "ApplicationID": pendingID})
+		return
+	}
+	if err != sql.ErrNoRows {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Store the application, the user type only changes once an admin approves it
+	result, err := db.Exec(
+		"INSERT INTO CarPoolOwnerApplication (UserID, DriverLicense, CarPlateNumber, Status, SubmissionDate) VALUES (?, ?, ?, ?, ?)",
+		userID, license, plate, applicationPending, time.Now().Format(dateTimeLayout),
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	applicationID, _ := result.LastInsertId()
+
+	jsonResponse(w, http.StatusAccepted, map[string]interface{}{"Message": "Application submitted for review", "ApplicationID": applicationID, "Status": applicationPending})
+}
+
+// getOwnerUpgrade returns the latest car owner application of a user
+func getOwnerUpgrade(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	application, err := scanOwnerApplication(db.QueryRow(
+		"SELECT "+ownerApplicationColumns+" FROM CarPoolOwnerApplication WHERE UserID = ? ORDER BY ApplicationID DESC LIMIT 1", userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "No application found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, newOwnerApplicationResponse(application))
+}
+
+// listOwnerUpgrades lists car owner applications for admins, filtered by the status query parameter (pending by default)
+func listOwnerUpgrades(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = applicationPending
+	}
+
+	rows, err := db.Query("SELECT "+ownerApplicationColumns+" FROM CarPoolOwnerApplication WHERE Status = ? ORDER BY SubmissionDate", status)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	// Add the data into the struct
+	applications := []OwnerApplicationResponse{}
+	for rows.Next() {
+		application, err := scanOwnerApplication(rows)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		applications = append(applications, newOwnerApplicationResponse(application))
+	}
+
+	jsonResponse(w, http.StatusOK, applications)
+}
+
+// approveOwnerUpgrade approves a pending application and turns the passenger into a car owner
+func approveOwnerUpgrade(w http.ResponseWriter, r *http.Request) {
+	reviewOwnerUpgrade(w, r, applicationApproved)
+}
+
+// rejectOwnerUpgrade rejects a pending application, the user stays a passenger
+func rejectOwnerUpgrade(w http.ResponseWriter, r *http.Request) {
+	reviewOwnerUpgrade(w, r, applicationRejected)
+}
+
+// reviewOwnerUpgrade records the decision of an admin on a pending application
+func reviewOwnerUpgrade(w http.ResponseWriter, r *http.Request, decision string) {
+	// Get the application ID from the request parameters
+	params := mux.Vars(r)
+	applicationID := params["applicationID"]
+
+	// The review note is optional
+	var body struct {
+		ReviewNote string `json:"ReviewNote"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": err.Error()})
+			return
+		}
+	}
+
+	// Review the application and update the user in a single transaction
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	application, err := scanOwnerApplication(tx.QueryRow(
+		"SELECT "+ownerApplicationColumns+" FROM CarPoolOwnerApplication WHERE ApplicationID = ? FOR UPDATE", applicationID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Application not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if application.Status != applicationPending {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Application has already been " + application.Status})
+		return
+	}
+
+	// Record the decision
+	now := time.Now().Format(dateTimeLayout)
+	_, err = tx.Exec(
+		"UPDATE CarPoolOwnerApplication SET Status = ?, ReviewDate = ?, ReviewerID = ?, ReviewNote = ? WHERE ApplicationID = ?",
+		decision, now, claimsFromContext(r).Subject, sql.NullString{String: body.ReviewNote, Valid: body.ReviewNote != ""}, application.ApplicationID,
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	// Only an approval changes the user, a passenger becomes a car owner and a car owner gets the new car details
+	if decision == applicationApproved {
+		before, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM CarPoolUser WHERE UserID = ? FOR UPDATE", application.UserID))
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		if (before.UserType != rolePassenger && before.UserType != roleCarOwner) || before.DeletionDate.Valid {
+			jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "The applicant is no longer an active passenger or car owner"})
+			return
+		}
+		action := historyOwnerApproved
+		if before.UserType == roleCarOwner {
+			action = historyCarDetailsChanged
+		}
+		after := before
+		after.UserType = roleCarOwner
+		after.DriverLicense = textValue(application.DriverLicense)
+		after.CarPlateNumber = textValue(application.CarPlateNumber)
+		_, err = tx.Exec(
+			"UPDATE CarPoolUser SET UserType = ?, DriverLicense = ?, CarPlateNumber = ?, LastUpdate = ? WHERE UserID = ?",
+			after.UserType, after.DriverLicense, after.CarPlateNumber, now, application.UserID,
+		)
+		if err == nil {
+			err = recordHistory(tx, r, application.UserID, action, profileChanges(before, after))
+		}
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Application " + decision, "ApplicationID": application.ApplicationID, "Status": decision})
+}
+
+// downgradeOwner turns a car owner back into a passenger, as long as they have no upcoming trips
+func downgradeOwner(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Lock the user row so that the check and the downgrade happen together
+	before, err := scanUser(tx.QueryRow("SELECT "+userColumns+" FROM CarPoolUser WHERE UserID = ? AND DeletionDate IS NULL FOR UPDATE", userID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if before.UserType != roleCarOwner {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Only car owners can be downgraded"})
+		return
+	}
+
+	// Look for trips that are in progress or still to come, trip times are compared in Singapore time whatever the server's time zone
+	rows, err := tx.Query(
+		"SELECT TripID FROM CarPoolTrip WHERE UserID = ? AND (TripStatus = 'started' OR (TripStatus IN ('created', 'fully booked') AND StartDateTime > ?))",
+		userID, time.Now().In(tripLocation).Format(dateTimeLayout),
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	tripIDs := []int{}
+	for rows.Next() {
+		var tripID int
+		if err := rows.Scan(&tripID); err != nil {
+			rows.Close()
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		tripIDs = append(tripIDs, tripID)
+	}
+	rows.Close()
+	if len(tripIDs) > 0 {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Cancel or complete your upcoming trips before downgrading", "TripIDs": tripIDs})
+		return
+	}
+
+	// Clear the car owner fields along with the user type
+	after := before
+	after.UserType = rolePassenger
+	after.DriverLicense, after.CarPlateNumber = sql.NullString{}, sql.NullString{}
+	_, err = tx.Exec(
+		"UPDATE CarPoolUser SET UserType = ?, DriverLicense = NULL, CarPlateNumber = NULL, LastUpdate = ? WHERE UserID = ?",
+		after.UserType, time.Now().Format(dateTimeLayout), userID,
+	)
+	if err == nil {
+		err = recordHistory(tx, r, before.UserID, historyOwnerDowngraded, profileChanges(before, after))
+	}
+	if err == nil {
+		// Passengers have no vehicles
+		now := time.Now().Format(dateTimeLayout)
+		_, err = tx.Exec("UPDATE CarPoolVehicle SET RetiredDate = ?, LastUpdate = ? WHERE UserID = ? AND RetiredDate IS NULL", now, now, before.UserID)
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	userIDInt, _ := strconv.Atoi(userID)
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Account downgraded to passenger", "UserID": userIDInt, "UserType": rolePassenger})
+}
@@ -9,33 +9,48 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
-// User represents a user in the system
+// User represents a user in the system, as stored in CarPoolUser (see dto.go for the API models)
 type User struct {
-	UserID         int            `json:"UserID"`
-	FirstName      string         `json:"FirstName"`
-	LastName       string         `json:"LastName"`
-	MobileNumber   string         `json:"MobileNumber"`
-	EmailAddress   string         `json:"EmailAddress"`
-	UserPassword   string         `json:"UserPassword"`
-	DriverLicense  sql.NullString `json:"DriverLicense,omitempty"`
-	CarPlateNumber sql.NullString `json:"CarPlateNumber,omitempty"`
-	CreationDate   string         `json:"CreationDate"`
-	LastUpdate     string         `json:"LastUpdate"`
-	DeletionDate   sql.NullString `json:"DeletionDate,omitempty"`
-	UserType       string         `json:"UserType"`
+	UserID            int            `json:"UserID"`
+	FirstName         string         `json:"FirstName"`
+	LastName          string         `json:"LastName"`
+	MobileNumber      string         `json:"MobileNumber"`
+	EmailAddress      string         `json:"EmailAddress"`
+	UserPassword      string         `json:"-"`
+	DriverLicense     sql.NullString `json:"DriverLicense,omitempty"`
+	CarPlateNumber    sql.NullString `json:"CarPlateNumber,omitempty"`
+	CreationDate      string         `json:"CreationDate"`
+	LastUpdate        string         `json:"LastUpdate"`
+	DeletionDate      sql.NullString `json:"DeletionDate,omitempty"`
+	UserType          string         `json:"UserType"`
+	EmailVerifiedDate sql.NullString `json:"EmailVerifiedDate,omitempty"`
+	SuspendedDate     sql.NullString `json:"SuspendedDate,omitempty"`
+	SuspensionReason  sql.NullString `json:"SuspensionReason,omitempty"`
+	PhotoID           sql.NullString `json:"PhotoID,omitempty"`
 }
 
+// dateTimeLayout is the format of the date and time columns in the database
+const dateTimeLayout = "2006-01-02 15:04:05"
+
 // db is the database connection pool
 var db *sql.DB
 
 // main handles the connection to the database server and initializes the router for the API requests
 func main() {
+	// Load the password hashing and token signing settings
+	loadPasswordConfig()
+	loadTokenConfig()
+	loadMailerConfig()
+	loadPhotoConfig()
+
 	// Connect to the database server
 	var err error
 	db, err = sql.Open("mysql", "user:password@tcp(127.0.0.1:3306)/CAR_POOL")
@@ -44,19 +59,66 @@ func main() {
 	}
 	defer db.Close()
 
+	// Create the first admin account when one is configured
+	bootstrapAdmin()
+
+	// Start anonymising accounts whose retention period has ended
+	startPurgeWorker()
+
 	// Initialize the router
 	router := mux.NewRouter()
 
 	// Register the API endpoints with the router
-	router.HandleFunc("/api/v1/users/{userID}", getUserData).Methods("GET")
+	router.HandleFunc("/api/v1/users/verify", verifyEmail).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}", requireAuth(requireSelf(getUserData))).Methods("GET")
 	router.HandleFunc("/api/v1/users", createUser).Methods("POST")
-	router.HandleFunc("/api/v1/users/{userID}", updateUser).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/v1/users/{userID}", requireAuth(requireSelf(updateUser))).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/api/v1/users/{userID}", requireAuth(requireSelf(patchUser))).Methods("PATCH")
+	router.HandleFunc("/api/v1/users/{userID}/password", requireAuth(requireSelf(changePassword))).Methods("PUT")
+	router.HandleFunc("/api/v1/users/{userID}/exports", requireAuth(requireSelf(requestDataExport))).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}/exports/{exportID}", requireAuth(requireSelf(getDataExport))).Methods("GET")
+	router.HandleFunc("/api/v1/exports/{exportID}/download", downloadDataExport).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}/photo", requireAuth(requireSelf(uploadPhoto))).Methods("PUT")
+	router.HandleFunc("/api/v1/users/{userID}/photo", requireAuth(requireSelf(deletePhoto))).Methods("DELETE")
+	router.HandleFunc("/api/v1/photos/{photoID}/{size}", servePhoto).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}/history", requireAuth(requireSelf(getUserHistory))).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}/verification", requireAuth(requireSelf(resendVerification))).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}/2fa", requireAuth(requireSelf(getTwoFactor))).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}/2fa", requireAuth(requireSelf(enrolTwoFactor))).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}/2fa", requireAuth(requireSelf(disableTwoFactor))).Methods("DELETE")
+	router.HandleFunc("/api/v1/users/{userID}/2fa/verify", requireAuth(requireSelf(confirmTwoFactor))).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}/2fa/recovery-codes", requireAuth(requireSelf(regenerateRecoveryCodes))).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}", requireAuth(requireSelf(deleteUser))).Methods("DELETE")
 	router.HandleFunc("/api/v1/authenticate", authenticateUser).Methods("POST")
+	router.HandleFunc("/api/v1/authenticate/2fa", completeTwoFactorLogin).Methods("POST")
+	router.HandleFunc("/api/v1/token/refresh", refreshSession).Methods("POST")
+	router.HandleFunc("/api/v1/logout", requireAuth(logoutUser)).Methods("POST")
+	router.HandleFunc("/api/v1/password-reset", requestPasswordReset).Methods("POST")
+	router.HandleFunc("/api/v1/password-reset/confirm", confirmPasswordReset).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}/sessions", requireAuth(requireSelf(getUserSessions))).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}/sessions", requireAuth(requireSelf(revokeUserSessions))).Methods("DELETE")
+	router.HandleFunc("/api/v1/users/{userID}/sessions/{sessionID}", requireAuth(requireSelf(revokeUserSession))).Methods("DELETE")
+	router.HandleFunc("/api/v1/users/{userID}/vehicles", requireAuth(requireSelf(getVehicles))).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}/vehicles", requireAuth(requireAction(actionManageVehicles, requireSelf(registerVehicle)))).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}/vehicles/{vehicleID}", requireAuth(requireAction(actionManageVehicles, requireSelf(updateVehicle)))).Methods("PUT")
+	router.HandleFunc("/api/v1/users/{userID}/vehicles/{vehicleID}", requireAuth(requireAction(actionManageVehicles, requireSelf(retireVehicle)))).Methods("DELETE")
+	router.HandleFunc("/api/v1/users/{userID}/upgrade", requireAuth(requireSelf(requireAction(actionApplyOwner, requestOwnerUpgrade)))).Methods("POST")
+	router.HandleFunc("/api/v1/users/{userID}/upgrade", requireAuth(requireSelf(getOwnerUpgrade))).Methods("GET")
+	router.HandleFunc("/api/v1/users/{userID}/downgrade", requireAuth(requireSelf(requireAction(actionDowngradeOwner, downgradeOwner)))).Methods("POST")
+	router.HandleFunc("/api/v1/admin/upgrades", requireAuth(requireAction(actionReviewOwnerUsers, listOwnerUpgrades))).Methods("GET")
+	router.HandleFunc("/api/v1/admin/upgrades/{applicationID}/approve", requireAuth(requireAction(actionReviewOwnerUsers, approveOwnerUpgrade))).Methods("POST")
+	router.HandleFunc("/api/v1/admin/upgrades/{applicationID}/reject", requireAuth(requireAction(actionReviewOwnerUsers, rejectOwnerUpgrade))).Methods("POST")
+	router.HandleFunc("/api/v1/admin/users", requireAuth(requireAction(actionManageUsers, listUsers))).Methods("GET")
+	router.HandleFunc("/api/v1/admin/users/{userID}/suspend", requireAuth(requireAction(actionManageUsers, suspendUser))).Methods("POST")
+	router.HandleFunc("/api/v1/admin/users/{userID}/reinstate", requireAuth(requireAction(actionManageUsers, reinstateUser))).Methods("POST")
+	router.HandleFunc("/api/v1/admin/lockouts", requireAuth(requireAction(actionManageLockouts, listLockouts))).Methods("GET")
+	router.HandleFunc("/api/v1/admin/lockouts/{lockoutID}", requireAuth(requireAction(actionManageLockouts, clearLockout))).Methods("DELETE")
 
 	// Create a new CORS handler
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3000"},
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
 		AllowCredentials: true,
 		Debug:            true,
 	})
@@ -76,41 +138,76 @@ func getUserData(w http.ResponseWriter, r *http.Request) {
 	userID := params["userID"]
 
 	// Query the database to get user data based on the provided user ID
-	var userData User
-	err := db.QueryRow("SELECT * FROM CarPoolUser WHERE UserID = ?", userID).
-		Scan(&userData.UserID, &userData.FirstName, &userData.LastName, &userData.MobileNumber,
-			&userData.EmailAddress, &userData.UserPassword, &userData.DriverLicense,
-			&userData.CarPlateNumber, &userData.CreationDate, &userData.LastUpdate,
-			&userData.DeletionDate, &userData.UserType)
+	userData, err := loadUser(userID)
 	if err != nil {
 		// Handle errors appropriately
 		fmt.Println(err)
-		http.Error(w, "Error fetching user data", http.StatusInternalServerError)
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Error fetching user data", http.StatusInternalServerError)
+		}
 		return
 	}
 
 	// Convert user data to JSON and write it to the response
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(userData)
+	json.NewEncoder(w).Encode(newUserResponse(userData))
 }
 
 // createUser handles the creation of user accounts
 func createUser(w http.ResponseWriter, r *http.Request) {
-	// Decode the request body into a User struct
-	var newUser User
-	err := json.NewDecoder(r.Body).Decode(&newUser)
+	// Decode the request body into a registration request
+	var request RegisterUserRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		fmt.Println(err)
 		return
 	}
+	newUser := request.toUser()
 
-	// Perform validation and store user in the database
+	// Moderator accounts cannot be self-registered
+	if newUser.UserType == roleAdmin {
+		http.Error(w, "Admin accounts can only be assigned by an admin", http.StatusForbidden)
+		return
+	}
+
+	// Perform validation, every invalid field is reported at once
+	normalizeProfile(&newUser)
+	newUser.DriverLicense.String = normalizeIdentifier(newUser.DriverLicense.String)
+	newUser.CarPlateNumber.String = normalizeIdentifier(newUser.CarPlateNumber.String)
+	if errs := validateRegistration(newUser); len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, "Validation failed", errs)
+		return
+	}
+
+	// The email address and mobile number identify a single account
+	if checkUniqueProfile(w, newUser) {
+		return
+	}
+
+	// Hash the password before it is stored
+	newUser.UserPassword, err = hashPassword(newUser.UserPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		fmt.Println(err)
+		return
+	}
+
+	// Store user in the database, the dates are set by the server
+	now := time.Now().Format(dateTimeLayout)
+	newUser.CreationDate, newUser.LastUpdate = now, now
 	result, err := db.Exec(
 		"INSERT INTO CarPoolUser (FirstName, LastName, MobileNumber, EmailAddress, UserPassword, DriverLicense, CarPlateNumber, CreationDate, LastUpdate, UserType) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
 		newUser.FirstName, newUser.LastName, newUser.MobileNumber, newUser.EmailAddress, newUser.UserPassword, newUser.DriverLicense, newUser.CarPlateNumber, newUser.CreationDate, newUser.LastUpdate, newUser.UserType,
 	)
 	if err != nil {
+		// A concurrent registration may have taken the email address or mobile number
+		if errs := duplicateFieldErrors(err); errs != nil {
+			writeFieldErrors(w, http.StatusConflict, "Account details already in use", errs)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		fmt.Println(err)
 		return
@@ -127,46 +224,131 @@ func createUser(w http.ResponseWriter, r *http.Request) {
 	// Update the user ID in the newUser struct
 	newUser.UserID = int(lastInsertID)
 
+	// Start the history of the account with its initial profile
+	changes := profileChanges(User{}, newUser)
+	for i := range changes {
+		changes[i].OldValue = sql.NullString{}
+	}
+	changes = append(changes, FieldChange{"UserPassword", sql.NullString{}, textValue(newUser.UserPassword)})
+	if err := recordHistory(db, r, newUser.UserID, historyRegistered, changes); err != nil {
+		fmt.Println(err)
+	}
+
+	// Send the verification link, the account cannot book or publish trips until it is opened
+	if err := sendVerificationEmail(newUser.UserID, newUser.EmailAddress, newUser.FirstName); err != nil {
+		fmt.Println(err)
+	}
+
 	// Return a response with the user ID
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"UserID": lastInsertID,
-		"User":   newUser,
+		"User":   newUserResponse(newUser),
 	})
 }
 
-// updateUser handles the update of user accounts
+// updateUser handles the update of user accounts, every editable profile field is replaced
 func updateUser(w http.ResponseWriter, r *http.Request) {
 	// Get the user ID from the request parameters
 	params := mux.Vars(r)
 	userID := params["userID"]
 
-	// Decode the request body into a User struct
-	var updatedUser User
-	err := json.NewDecoder(r.Body).Decode(&updatedUser)
+	// Decode the request body into a profile update request
+	var request UpdateUserRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		fmt.Println(err)
 		return
 	}
+	updatedUser := request.toUser()
 
-	// Perform validation and update user in the database
-	_, err = db.Exec(
-		"UPDATE CarPoolUser SET FirstName=?, LastName=?, MobileNumber=?, EmailAddress=?, UserPassword=?, DriverLicense=?, CarPlateNumber=?, CreationDate=?, LastUpdate=?, DeletionDate=?, UserType=? WHERE UserID=?",
-		updatedUser.FirstName, updatedUser.LastName, updatedUser.MobileNumber, updatedUser.EmailAddress, updatedUser.UserPassword, updatedUser.DriverLicense, updatedUser.CarPlateNumber, updatedUser.CreationDate, updatedUser.LastUpdate, updatedUser.DeletionDate, updatedUser.UserType, userID,
-	)
+	// Load the current profile
+	current, err := loadUser(userID)
 	if err != nil {
+		if err == errUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		fmt.Println(err)
+		return
+	}
+
+	// Perform validation, the ID, password and dates are never taken from the client
+	updatedUser.UserID = current.UserID
+	normalizeProfile(&updatedUser)
+	if errs := validateProfileChange(current, updatedUser); len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, "Validation failed", errs)
+		return
+	}
+	if status, err := checkProfileChange(current, &updatedUser, claimsFromContext(r).UserType); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if checkUniqueProfile(w, updatedUser) {
+		return
+	}
+
+	// Update user in the database
+	if err := saveProfile(r, current, updatedUser); err != nil {
+		if errs := duplicateFieldErrors(err); errs != nil {
+			writeFieldErrors(w, http.StatusConflict, "Account details already in use", errs)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		fmt.Println(err)
 		return
 	}
 
-	// Return a response
+	// Return the stored profile
+	saved, err := loadUser(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(updatedUser)
+	json.NewEncoder(w).Encode(newUserResponse(saved))
 }
 
-// authenticateUser authenticates a user and returns the user ID, user type, first name, and a response code
+// deleteUser handles the deletion of user accounts, the account is soft-deleted and purged after a year
+func deleteUser(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userID"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	// Mark the account as deleted, which blocks future logins
+	now := time.Now().Format(dateTimeLayout)
+	result, err := db.Exec("UPDATE CarPoolUser SET DeletionDate = ?, LastUpdate = ? WHERE UserID = ? AND DeletionDate IS NULL", now, now, userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fmt.Println(err)
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		http.Error(w, "User not found or already deleted", http.StatusNotFound)
+		return
+	}
+	if err := recordHistory(db, r, userID, historyAccountDeleted, []FieldChange{{"DeletionDate", sql.NullString{}, textValue(now)}}); err != nil {
+		fmt.Println(err)
+	}
+
+	// Log the account out everywhere
+	if _, err := revokeAllSessions(userID); err != nil {
+		fmt.Println(err)
+	}
+
+	// Return a response
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Account deleted", "DeletionDate": now})
+}
+
+// authenticateUser authenticates a user and returns the user ID, user type, first name, signed access and refresh tokens and a response code,
+// or a challenge for the second factor when two-factor authentication is enabled
 func authenticateUser(w http.ResponseWriter, r *http.Request) {
 	// Decode the request body into a struct
 	var credentials struct {
@@ -179,13 +361,32 @@ func authenticateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Query the database to check if the user exists and get UserID, UserType, and FirstName
+	// Refuse the attempt while the email address or the client IP address is backing off or locked out
+	now := time.Now()
+	keys := loginThrottleKeys(credentials.EmailAddress, r)
+	wait, err := loginBlockedFor(keys, now)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if wait > 0 {
+		writeLoginBlocked(w, wait)
+		return
+	}
+
+	// Query the database to check if the user exists and get UserID, UserType, FirstName and the stored password
 	var userID int
-	var userType, firstName string
-	err = db.QueryRow("SELECT UserID, UserType, FirstName FROM CarPoolUser WHERE EmailAddress = ? AND UserPassword = ? AND DeletionDate IS NULL", credentials.EmailAddress, credentials.UserPassword).Scan(&userID, &userType, &firstName)
+	var userType, firstName, storedPassword string
+	var emailVerifiedDate, suspendedDate sql.NullString
+	err = db.QueryRow("SELECT UserID, UserType, FirstName, UserPassword, EmailVerifiedDate, SuspendedDate FROM CarPoolUser WHERE EmailAddress = ? AND DeletionDate IS NULL", credentials.EmailAddress).Scan(&userID, &userType, &firstName, &storedPassword, &emailVerifiedDate, &suspendedDate)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			// User not found or incorrect password
+			// User not found, answer exactly like a wrong password
+			burnPasswordCheck(credentials.UserPassword)
+			if err := recordLoginFailure(keys, sql.NullInt64{}, now); err != nil {
+				fmt.Println(err)
+			}
 			jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid email or password"})
 		} else {
 			// Other database error
@@ -194,9 +395,49 @@ func authenticateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Authentication successful
-	response := map[string]interface{}{"UserID": userID, "UserType": userType, "FirstName": firstName, "Message": "Authenticated successfully"}
-	jsonResponse(w, http.StatusOK, response)
+	// Check the password against the stored hash
+	match, needsRehash := checkPassword(storedPassword, credentials.UserPassword)
+	if !match {
+		if err := recordLoginFailure(keys, sql.NullInt64{Int64: int64(userID), Valid: true}, now); err != nil {
+			fmt.Println(err)
+		}
+		jsonResponse(w, http.StatusUnauthorized, map[string]interface{}{"Message": "Invalid email or password"})
+		return
+	}
+
+	// Suspended accounts are told so, but only once the password has proven who is asking
+	if suspendedDate.Valid {
+		jsonResponse(w, http.StatusForbidden, map[string]interface{}{"Message": "Account suspended, please contact support"})
+		return
+	}
+
+	// Upgrade legacy plaintext passwords (or outdated hashes) now that the plaintext is known
+	if needsRehash {
+		if hashed, err := hashPassword(credentials.UserPassword); err != nil {
+			fmt.Println(err)
+		} else if _, err := db.Exec("UPDATE CarPoolUser SET UserPassword = ? WHERE UserID = ?", hashed, userID); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	// Accounts with two-factor authentication still need a code, failures are only cleared once it is given
+	enabled, err := twoFactorEnabled(userID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if enabled {
+		startTwoFactorChallenge(w, userID)
+		return
+	}
+	if err := recordLoginSuccess(keys); err != nil {
+		fmt.Println(err)
+	}
+
+	// Authentication successful, record the session and issue its tokens
+	response := map[string]interface{}{"UserID": userID, "UserType": userType, "FirstName": firstName, "EmailVerified": emailVerifiedDate.Valid, "Message": "Authenticated successfully"}
+	issueSessionTokens(w, r, userID, userType, response)
 }
 
 // jsonResponse writes a JSON response with the given status code and data
@@ -0,0 +1,212 @@
+// validate.go
+
+package main
+
+// import all the necessary packages
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Limits of the user fields, matching the CarPoolUser columns
+const (
+	maxNameLength     = 50
+	maxEmailLength    = 100
+	minPasswordLength = 8
+	maxPasswordBytes  = 72 // bcrypt ignores anything longer
+)
+
+// mobileNumberPattern matches a Singapore mobile number once the country code and spaces are removed
+var mobileNumberPattern = regexp.MustCompile(`^[89][0-9]{7}$`)
+
+// mysqlDuplicateEntry is the MySQL error number of a unique constraint violation
+const mysqlDuplicateEntry = 1062
+
+// FieldErrors maps the name of each invalid field to the reason it was rejected
+type FieldErrors map[string]string
+
+// writeFieldErrors answers with the field-level errors of a request
+func writeFieldErrors(w http.ResponseWriter, status int, message string, errs FieldErrors) {
+	jsonResponse(w, status, map[string]interface{}{"Message": message, "Errors": errs})
+}
+
+// normalizeEmail trims and lower-cases an email address
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// normalizeMobileNumber removes spaces, dashes and the +65 country code from a mobile number
+func normalizeMobileNumber(mobile string) string {
+	mobile = strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(mobile))
+	return strings.TrimPrefix(mobile, "+65")
+}
+
+// normalizeProfile trims the profile fields so that they are validated and stored consistently
+func normalizeProfile(user *User) {
+	user.FirstName = strings.TrimSpace(user.FirstName)
+	user.LastName = strings.TrimSpace(user.LastName)
+	user.EmailAddress = normalizeEmail(user.EmailAddress)
+	user.MobileNumber = normalizeMobileNumber(user.MobileNumber)
+}
+
+// validateProfile checks the syntax of the profile fields of a user
+func validateProfile(user User) FieldErrors {
+	errs := FieldErrors{}
+
+	// Names must be present and fit in their columns
+	for field, name := range map[string]string{"FirstName": user.FirstName, "LastName": user.LastName} {
+		if name == "" {
+			errs[field] = "is required"
+		} else if utf8.RuneCountInString(name) > maxNameLength {
+			errs[field] = "must be at most 50 characters"
+		}
+	}
+
+	// The address must be a bare email address with a domain
+	if user.EmailAddress == "" {
+		errs["EmailAddress"] = "is required"
+	} else if address, err := mail.ParseAddress(user.EmailAddress); err != nil || address.Address != user.EmailAddress ||
+		!strings.Contains(user.EmailAddress[strings.LastIndex(user.EmailAddress, "@")+1:], ".") {
+		errs["EmailAddress"] = "is not a valid email address"
+	} else if len(user.EmailAddress) > maxEmailLength {
+		errs["EmailAddress"] = "must be at most 100 characters"
+	}
+
+	// Only Singapore mobile numbers are accepted
+	if user.MobileNumber == "" {
+		errs["MobileNumber"] = "is required"
+	} else if !mobileNumberPattern.MatchString(user.MobileNumber) {
+		errs["MobileNumber"] = "must be a Singapore mobile number of 8 digits starting with 8 or 9"
+	}
+	return errs
+}
+
+// validateProfileChange checks the profile fields that differ from the current profile,
+// so that legacy values which are left untouched do not block an edit
+func validateProfileChange(current, updated User) FieldErrors {
+	errs := validateProfile(updated)
+	unchanged := map[string]bool{
+		"FirstName":    current.FirstName == updated.FirstName,
+		"LastName":     current.LastName == updated.LastName,
+		"EmailAddress": current.EmailAddress == updated.EmailAddress,
+		"MobileNumber": current.MobileNumber == updated.MobileNumber,
+	}
+	for field := range errs {
+		if unchanged[field] {
+			delete(errs, field)
+		}
+	}
+	return errs
+}
+
+// validatePassword checks a new password against the password policy
+func validatePassword(password string) string {
+	if utf8.RuneCountInString(password) < minPasswordLength {
+		return "must be at least 8 characters"
+	}
+	if len(password) > maxPasswordBytes {
+		return "must be at most 72 bytes"
+	}
+
+	// Require a mix of letters and digits
+	var hasLetter, hasDigit bool
+	for _, c := range password {
+		hasLetter = hasLetter || unicode.IsLetter(c)
+		hasDigit = hasDigit || unicode.IsDigit(c)
+	}
+	if !hasLetter || !hasDigit {
+		return "must contain at least one letter and one digit"
+	}
+	return ""
+}
+
+// validateRegistration checks every field of a new account and collects the errors by field
+func validateRegistration(user User) FieldErrors {
+	errs := validateProfile(user)
+	if reason := validatePassword(user.UserPassword); reason != "" {
+		errs["UserPassword"] = reason
+	}
+
+	// Everyone registers as a passenger, car owners are approved by an admin after applying
+	switch user.UserType {
+	case rolePassenger:
+		if user.DriverLicense.String != "" {
+			errs["DriverLicense"] = "can only be set by applying with POST /api/v1/users/{userID}/upgrade"
+		}
+		if user.CarPlateNumber.String != "" {
+			errs["CarPlateNumber"] = "can only be set by applying with POST /api/v1/users/{userID}/upgrade"
+		}
+	case roleCarOwner:
+		errs["UserType"] = "must be 'passenger', register first and apply with POST /api/v1/users/{userID}/upgrade to become a car owner"
+	default:
+		errs["UserType"] = "must be 'passenger'"
+	}
+	return errs
+}
+
+// findConflicts reports the email address or mobile number already used by another account
+func findConflicts(user User) (FieldErrors, error) {
+	errs := FieldErrors{}
+	rows, err := db.Query(
+		"SELECT EmailAddress, MobileNumber FROM CarPoolUser WHERE (EmailAddress = ? OR MobileNumber = ?) AND UserID <> ?",
+		user.EmailAddress, user.MobileNumber, user.UserID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email, mobile string
+		if err := rows.Scan(&email, &mobile); err != nil {
+			return nil, err
+		}
+		if strings.EqualFold(email, user.EmailAddress) {
+			errs["EmailAddress"] = "is already registered"
+		}
+		if mobile == user.MobileNumber {
+			errs["MobileNumber"] = "is already registered"
+		}
+	}
+	return errs, rows.Err()
+}
+
+// duplicateFieldErrors converts a unique constraint violation into field-level errors, or returns nil for other errors
+func duplicateFieldErrors(err error) FieldErrors {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) || mysqlErr.Number != mysqlDuplicateEntry {
+		return nil
+	}
+
+	// The constraint name tells which field clashed
+	switch {
+	case strings.Contains(mysqlErr.Message, "UniqueEmailAddress"):
+		return FieldErrors{"EmailAddress": "is already registered"}
+	case strings.Contains(mysqlErr.Message, "UniqueMobileNumber"):
+		return FieldErrors{"MobileNumber": "is already registered"}
+	}
+	return FieldErrors{"User": "already exists"}
+}
+
+// checkUniqueProfile answers with 409 Conflict when the email address or mobile number of the user is taken, and reports whether it did
+func checkUniqueProfile(w http.ResponseWriter, user User) bool {
+	conflicts, err := findConflicts(user)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return true
+	}
+	if len(conflicts) > 0 {
+		writeFieldErrors(w, http.StatusConflict, "Account details already in use", conflicts)
+		return true
+	}
+	return false
+}
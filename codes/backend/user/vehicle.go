@@ -0,0 +1,298 @@
+// vehicle.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxPassengerCapacity is the largest number of passengers a registered vehicle may carry
+const maxPassengerCapacity = 7
+
+// vehicleColumns lists the CarPoolVehicle columns scanned by scanVehicle
+const vehicleColumns = "VehicleID, UserID, Make, Model, Colour, CarPlateNumber, PassengerCapacity, CreationDate, LastUpdate"
+
+// Vehicle represents a car registered by a car owner
+type Vehicle struct {
+	VehicleID         int    `json:"VehicleID"`
+	UserID            int    `json:"UserID"`
+	Make              string `json:"Make"`
+	Model             string `json:"Model"`
+	Colour            string `json:"Colour"`
+	CarPlateNumber    string `json:"CarPlateNumber"`
+	PassengerCapacity int    `json:"PassengerCapacity"`
+	CreationDate      string `json:"CreationDate"`
+	LastUpdate        string `json:"LastUpdate"`
+}
+
+// VehicleRequest represents the body of a vehicle registration or update
+type VehicleRequest struct {
+	Make              string `json:"Make"`
+	Model             string `json:"Model"`
+	Colour            string `json:"Colour"`
+	CarPlateNumber    string `json:"CarPlateNumber"`
+	PassengerCapacity int    `json:"PassengerCapacity"`
+}
+
+// scanVehicle scans a row selected with vehicleColumns
+func scanVehicle(row interface{ Scan(...interface{}) error }) (Vehicle, error) {
+	var vehicle Vehicle
+	err := row.Scan(&vehicle.VehicleID, &vehicle.UserID, &vehicle.Make, &vehicle.Model, &vehicle.Colour,
+		&vehicle.CarPlateNumber, &vehicle.PassengerCapacity, &vehicle.CreationDate, &vehicle.LastUpdate)
+	return vehicle, err
+}
+
+// normalizeVehicle trims the text fields and normalises the car plate
+func normalizeVehicle(request *VehicleRequest) {
+	request.Make = strings.TrimSpace(request.Make)
+	request.Model = strings.TrimSpace(request.Model)
+	request.Colour = strings.TrimSpace(request.Colour)
+	request.CarPlateNumber = normalizeIdentifier(request.CarPlateNumber)
+}
+
+// validateVehicle checks every field of a vehicle and reports all problems at once
+func validateVehicle(request VehicleRequest) FieldErrors {
+	errs := FieldErrors{}
+	for field, value := range map[string]string{"Make": request.Make, "Model": request.Model, "Colour": request.Colour} {
+		if value == "" || len(value) > 50 {
+			errs[field] = "must be between 1 and 50 characters"
+		}
+	}
+	if !isValidCarPlate(request.CarPlateNumber) {
+		errs["CarPlateNumber"] = "is not a valid Singapore car plate"
+	}
+	if request.PassengerCapacity < 1 || request.PassengerCapacity > maxPassengerCapacity {
+		errs["PassengerCapacity"] = fmt.Sprintf("must be between 1 and %d", maxPassengerCapacity)
+	}
+	return errs
+}
+
+// checkPlateAvailable answers 409 and returns true when another active vehicle already has the car plate
+func checkPlateAvailable(w http.ResponseWriter, plate string, vehicleID int) bool {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM CarPoolVehicle WHERE CarPlateNumber = ? AND VehicleID <> ? AND RetiredDate IS NULL", plate, vehicleID).Scan(&count)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return true
+	}
+	if count > 0 {
+		writeFieldErrors(w, http.StatusConflict, "Vehicle already registered", FieldErrors{"CarPlateNumber": "is already registered"})
+		return true
+	}
+	return false
+}
+
+// upcomingVehicleTrips returns the trips still to come or in progress that use the vehicle and need more seats than minSeats
+func upcomingVehicleTrips(vehicleID, minSeats int) ([]int, error) {
+	rows, err := db.Query(
+		"SELECT TripID FROM CarPoolTrip WHERE VehicleID = ? AND AvailableSeats > ? AND (TripStatus = 'started' OR (TripStatus IN ('created', 'fully booked') AND StartDateTime > ?))",
+		vehicleID, minSeats, time.Now().Format(dateTimeLayout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tripIDs := []int{}
+	for rows.Next() {
+		var tripID int
+		if err := rows.Scan(&tripID); err != nil {
+			return nil, err
+		}
+		tripIDs = append(tripIDs, tripID)
+	}
+	return tripIDs, rows.Err()
+}
+
+// loadVehicle returns an active vehicle of a user
+func loadVehicle(userID, vehicleID interface{}) (Vehicle, error) {
+	return scanVehicle(db.QueryRow("SELECT "+vehicleColumns+" FROM CarPoolVehicle WHERE UserID = ? AND VehicleID = ? AND RetiredDate IS NULL", userID, vehicleID))
+}
+
+// getVehicles lists the active vehicles of a user
+func getVehicles(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	rows, err := db.Query("SELECT "+vehicleColumns+" FROM CarPoolVehicle WHERE UserID = ? AND RetiredDate IS NULL ORDER BY VehicleID", userID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer rows.Close()
+
+	// Add the data into the struct
+	vehicles := []Vehicle{}
+	for rows.Next() {
+		vehicle, err := scanVehicle(rows)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		vehicles = append(vehicles, vehicle)
+	}
+
+	jsonResponse(w, http.StatusOK, vehicles)
+}
+
+// registerVehicle adds a vehicle to the account of a car owner
+func registerVehicle(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID, _ := strconv.Atoi(params["userID"])
+
+	// Decode the request body into a vehicle request
+	var request VehicleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": err.Error()})
+		return
+	}
+
+	// Perform validation, every invalid field is reported at once
+	normalizeVehicle(&request)
+	if errs := validateVehicle(request); len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, "Validation failed", errs)
+		return
+	}
+	if checkPlateAvailable(w, request.CarPlateNumber, 0) {
+		return
+	}
+
+	// Store the vehicle in the database
+	now := time.Now().Format(dateTimeLayout)
+	result, err := db.Exec(
+		"INSERT INTO CarPoolVehicle (UserID, Make, Model, Colour, CarPlateNumber, PassengerCapacity, CreationDate, LastUpdate) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		userID, request.Make, request.Model, request.Colour, request.CarPlateNumber, request.PassengerCapacity, now, now,
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	vehicleID, _ := result.LastInsertId()
+
+	jsonResponse(w, http.StatusCreated, Vehicle{
+		VehicleID:         int(vehicleID),
+		UserID:            userID,
+		Make:              request.Make,
+		Model:             request.Model,
+		Colour:            request.Colour,
+		CarPlateNumber:    request.CarPlateNumber,
+		PassengerCapacity: request.PassengerCapacity,
+		CreationDate:      now,
+		LastUpdate:        now,
+	})
+}
+
+// updateVehicle replaces the details of a vehicle. The capacity cannot drop below the seats offered on its upcoming trips.
+func updateVehicle(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID and vehicle ID from the request parameters
+	params := mux.Vars(r)
+
+	vehicle, err := loadVehicle(params["userID"], params["vehicleID"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Vehicle not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+
+	// Decode the request body into a vehicle request
+	var request VehicleRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": err.Error()})
+		return
+	}
+
+	// Perform validation, every invalid field is reported at once
+	normalizeVehicle(&request)
+	if errs := validateVehicle(request); len(errs) > 0 {
+		writeFieldErrors(w, http.StatusBadRequest, "Validation failed", errs)
+		return
+	}
+	if request.CarPlateNumber != vehicle.CarPlateNumber && checkPlateAvailable(w, request.CarPlateNumber, vehicle.VehicleID) {
+		return
+	}
+	if request.PassengerCapacity < vehicle.PassengerCapacity {
+		tripIDs, err := upcomingVehicleTrips(vehicle.VehicleID, request.PassengerCapacity)
+		if err != nil {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+			return
+		}
+		if len(tripIDs) > 0 {
+			jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Upcoming trips offer more seats than the new capacity", "TripIDs": tripIDs})
+			return
+		}
+	}
+
+	// Update the vehicle in the database
+	vehicle.Make, vehicle.Model, vehicle.Colour = request.Make, request.Model, request.Colour
+	vehicle.CarPlateNumber, vehicle.PassengerCapacity = request.CarPlateNumber, request.PassengerCapacity
+	vehicle.LastUpdate = time.Now().Format(dateTimeLayout)
+	_, err = db.Exec(
+		"UPDATE CarPoolVehicle SET Make = ?, Model = ?, Colour = ?, CarPlateNumber = ?, PassengerCapacity = ?, LastUpdate = ? WHERE VehicleID = ?",
+		vehicle.Make, vehicle.Model, vehicle.Colour, vehicle.CarPlateNumber, vehicle.PassengerCapacity, vehicle.LastUpdate, vehicle.VehicleID,
+	)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, vehicle)
+}
+
+// retireVehicle removes a vehicle from the account, past trips keep referring to it
+func retireVehicle(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID and vehicle ID from the request parameters
+	params := mux.Vars(r)
+
+	vehicle, err := loadVehicle(params["userID"], params["vehicleID"])
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "Vehicle not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+
+	// Vehicles still needed for upcoming trips stay registered
+	tripIDs, err := upcomingVehicleTrips(vehicle.VehicleID, -1)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if len(tripIDs) > 0 {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Cancel or complete the upcoming trips of this vehicle first", "TripIDs": tripIDs})
+		return
+	}
+
+	now := time.Now().Format(dateTimeLayout)
+	_, err = db.Exec("UPDATE CarPoolVehicle SET RetiredDate = ?, LastUpdate = ? WHERE VehicleID = ?", now, now, vehicle.VehicleID)
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Vehicle removed", "VehicleID": vehicle.VehicleID})
+}
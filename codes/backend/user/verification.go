@@ -0,0 +1,175 @@
+// verification.go
+
+package main
+
+// import all the necessary packages
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Purposes of the one-time tokens stored in CarPoolUserToken
+const (
+	purposeEmailVerification = "email verification"
+	purposePasswordReset     = "password reset"
+)
+
+// emailVerificationTTL is how long a verification link stays valid
+const emailVerificationTTL = 24 * time.Hour
+
+// errInvalidUserToken is returned when a one-time token is unknown, expired or already used
+var errInvalidUserToken = errors.New("invalid or expired token")
+
+// createUserToken issues a one-time token for the user and purpose, replacing any unused token of the same purpose
+func createUserToken(userID int, purpose string, ttl time.Duration) (string, error) {
+	token, tokenHash, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+
+	// Earlier links stop working once a new one is sent
+	now := time.Now()
+	_, err = db.Exec(
+		"UPDATE CarPoolUserToken SET UsedDate = ? WHERE UserID = ? AND Purpose = ? AND UsedDate IS NULL",
+		now.Format(dateTimeLayout), userID, purpose,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO CarPoolUserToken (UserID, Purpose, TokenHash, CreationDate, ExpiryDate) VALUES (?, ?, ?, ?, ?)",
+		userID, purpose, tokenHash, now.Format(dateTimeLayout), now.Add(ttl).Format(dateTimeLayout),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumeUserToken marks a one-time token as used inside the transaction and returns the user it was issued to
+func consumeUserToken(tx *sql.Tx, token, purpose string) (int, error) {
+	var tokenID, userID int
+	now := time.Now().Format(dateTimeLayout)
+	err := tx.QueryRow(
+		"SELECT TokenID, UserID FROM CarPoolUserToken WHERE TokenHash = ? AND Purpose = ? AND UsedDate IS NULL AND ExpiryDate > ? FOR UPDATE",
+		hashSecretToken(token), purpose, now,
+	).Scan(&tokenID, &userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidUserToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE CarPoolUserToken SET UsedDate = ? WHERE TokenID = ?", now, tokenID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// sendVerificationEmail emails a new verification link to the user
+func sendVerificationEmail(userID int, emailAddress, firstName string) error {
+	token, err := createUserToken(userID, purposeEmailVerification, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := publicURL() + "/api/v1/users/verify?token=" + url.QueryEscape(token)
+	body := "Hi " + firstName + ",\n\n" +
+		"Please confirm your email address for your car-pooling account by opening this link within 24 hours:\n\n" +
+		link + "\n\n" +
+		"If you did not create an account, you can ignore this email."
+	return mailer.Send(emailAddress, "Confirm your email address", body)
+}
+
+// verifyEmail confirms the email address of the account that was sent the token
+func verifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "token is required"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// Use up the token and mark the address as verified together
+	userID, err := consumeUserToken(tx, token, purposeEmailVerification)
+	if err != nil {
+		if err == errInvalidUserToken {
+			jsonResponse(w, http.StatusBadRequest, map[string]interface{}{"Message": "Invalid or expired verification link"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	now := time.Now().Format(dateTimeLayout)
+	result, err := tx.Exec("UPDATE CarPoolUser SET EmailVerifiedDate = ? WHERE UserID = ? AND EmailVerifiedDate IS NULL", now, userID)
+	if err == nil {
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			err = recordHistory(tx, r, userID, historyEmailVerified, []FieldChange{{"EmailVerifiedDate", sql.NullString{}, textValue(now)}})
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, map[string]interface{}{"Message": "Email address verified", "UserID": userID})
+}
+
+// resendVerification sends a new verification link to a user whose email address is not verified yet
+func resendVerification(w http.ResponseWriter, r *http.Request) {
+	// Get the user ID from the request parameters
+	params := mux.Vars(r)
+	userID := params["userID"]
+
+	var user struct {
+		UserID       int
+		EmailAddress string
+		FirstName    string
+		Verified     sql.NullString
+	}
+	err := db.QueryRow("SELECT UserID, EmailAddress, FirstName, EmailVerifiedDate FROM CarPoolUser WHERE UserID = ? AND DeletionDate IS NULL", userID).
+		Scan(&user.UserID, &user.EmailAddress, &user.FirstName, &user.Verified)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			jsonResponse(w, http.StatusNotFound, map[string]interface{}{"Message": "User not found"})
+		} else {
+			fmt.Println(err)
+			jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Internal server error"})
+		}
+		return
+	}
+	if user.Verified.Valid {
+		jsonResponse(w, http.StatusConflict, map[string]interface{}{"Message": "Email address is already verified"})
+		return
+	}
+
+	if err := sendVerificationEmail(user.UserID, user.EmailAddress, user.FirstName); err != nil {
+		fmt.Println(err)
+		jsonResponse(w, http.StatusInternalServerError, map[string]interface{}{"Message": "Could not send the verification email"})
+		return
+	}
+	jsonResponse(w, http.StatusAccepted, map[string]interface{}{"Message": "Verification email sent"})
+}
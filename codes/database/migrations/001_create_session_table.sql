@@ -0,0 +1,16 @@
+-- Adds the session store used for refresh tokens, logout and session revocation
+USE CAR_POOL;
+
+CREATE TABLE IF NOT EXISTS CarPoolSession (
+    SessionID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    RefreshTokenHash CHAR(64) NOT NULL UNIQUE,
+    DeviceName VARCHAR(255) NOT NULL,
+    IPAddress VARCHAR(45) NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    LastSeen VARCHAR(50) NOT NULL,
+    ExpiryDate VARCHAR(50) NOT NULL,
+    RevocationDate VARCHAR(50),
+    INDEX (UserID, RevocationDate),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
@@ -0,0 +1,4 @@
+-- Adds the admin (moderator) role to the user types
+USE CAR_POOL;
+
+ALTER TABLE CarPoolUser MODIFY UserType ENUM('passenger', 'car owner', 'admin') NOT NULL;
@@ -0,0 +1,4 @@
+-- Records when a deleted account was anonymised by the purge worker
+USE CAR_POOL;
+
+ALTER TABLE CarPoolUser ADD COLUMN PurgeDate VARCHAR(50);
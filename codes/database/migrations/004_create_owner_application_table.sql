@@ -0,0 +1,17 @@
+-- Adds the car owner applications reviewed by admins before a passenger becomes a car owner
+USE CAR_POOL;
+
+CREATE TABLE IF NOT EXISTS CarPoolOwnerApplication (
+    ApplicationID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    DriverLicense VARCHAR(20) NOT NULL,
+    CarPlateNumber VARCHAR(15) NOT NULL,
+    Status ENUM('pending', 'approved', 'rejected') NOT NULL,
+    SubmissionDate VARCHAR(50) NOT NULL,
+    ReviewDate VARCHAR(50),
+    ReviewerID INT,
+    ReviewNote VARCHAR(255),
+    INDEX (UserID, Status),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID),
+    FOREIGN KEY (ReviewerID) REFERENCES CarPoolUser(UserID)
+);
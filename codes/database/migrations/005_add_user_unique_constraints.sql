@@ -0,0 +1,9 @@
+-- Makes the email address and mobile number identify a single account
+-- Resolve existing duplicates first, the query below lists them
+USE CAR_POOL;
+
+-- SELECT EmailAddress, COUNT(*) FROM CarPoolUser GROUP BY EmailAddress HAVING COUNT(*) > 1;
+-- SELECT MobileNumber, COUNT(*) FROM CarPoolUser GROUP BY MobileNumber HAVING COUNT(*) > 1;
+
+ALTER TABLE CarPoolUser ADD CONSTRAINT UniqueEmailAddress UNIQUE (EmailAddress);
+ALTER TABLE CarPoolUser ADD CONSTRAINT UniqueMobileNumber UNIQUE (MobileNumber);
@@ -0,0 +1,17 @@
+-- Adds email verification, accounts that already exist are treated as verified
+USE CAR_POOL;
+
+ALTER TABLE CarPoolUser ADD COLUMN EmailVerifiedDate VARCHAR(50);
+UPDATE CarPoolUser SET EmailVerifiedDate = LastUpdate WHERE UserID > 0 AND DeletionDate IS NULL;
+
+CREATE TABLE IF NOT EXISTS CarPoolUserToken (
+    TokenID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    Purpose ENUM('email verification') NOT NULL,
+    TokenHash CHAR(64) NOT NULL UNIQUE,
+    CreationDate VARCHAR(50) NOT NULL,
+    ExpiryDate VARCHAR(50) NOT NULL,
+    UsedDate VARCHAR(50),
+    INDEX (UserID, Purpose),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
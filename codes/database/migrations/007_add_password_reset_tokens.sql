@@ -0,0 +1,4 @@
+-- Allows one-time tokens to be used for password resets
+USE CAR_POOL;
+
+ALTER TABLE CarPoolUserToken MODIFY Purpose ENUM('email verification', 'password reset') NOT NULL;
@@ -0,0 +1,28 @@
+-- Adds brute-force protection for logins
+USE CAR_POOL;
+
+-- Create the Login Throttle Table, failed logins counted per email address and per client IP address
+CREATE TABLE IF NOT EXISTS CarPoolLoginThrottle (
+    KeyType ENUM('account', 'ip') NOT NULL,
+    KeyValue VARCHAR(100) NOT NULL,
+    FailureCount INT NOT NULL,
+    LastFailure VARCHAR(50) NOT NULL,
+    BlockedUntil VARCHAR(50),
+    PRIMARY KEY (KeyType, KeyValue)
+);
+
+-- Create the Lockout Table, a record of every lockout for the admins
+CREATE TABLE IF NOT EXISTS CarPoolLockout (
+    LockoutID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    KeyType ENUM('account', 'ip') NOT NULL,
+    KeyValue VARCHAR(100) NOT NULL,
+    UserID INT,
+    FailureCount INT NOT NULL,
+    LockedDate VARCHAR(50) NOT NULL,
+    LockedUntil VARCHAR(50) NOT NULL,
+    ClearedDate VARCHAR(50),
+    ClearedBy INT,
+    INDEX (ClearedDate, LockedUntil),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID),
+    FOREIGN KEY (ClearedBy) REFERENCES CarPoolUser(UserID)
+);
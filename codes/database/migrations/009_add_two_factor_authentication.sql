@@ -0,0 +1,25 @@
+-- Adds TOTP two-factor authentication, and one-time tokens for the second step of a login
+USE CAR_POOL;
+
+ALTER TABLE CarPoolUserToken MODIFY Purpose ENUM('email verification', 'password reset', 'two-factor login') NOT NULL;
+
+-- Create the Two-Factor Table, the TOTP secret of each user who set one up
+CREATE TABLE IF NOT EXISTS CarPoolTwoFactor (
+    UserID INT NOT NULL PRIMARY KEY,
+    Secret VARCHAR(64) NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    EnabledDate VARCHAR(50),
+    LastUsedStep BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the Recovery Code Table, single-use codes for a lost authenticator
+CREATE TABLE IF NOT EXISTS CarPoolRecoveryCode (
+    CodeID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    CodeHash CHAR(64) NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    UsedDate VARCHAR(50),
+    INDEX (UserID),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
@@ -0,0 +1,18 @@
+-- Records every change to a user profile
+USE CAR_POOL;
+
+-- Create the User History Table, one row per profile field changed
+CREATE TABLE IF NOT EXISTS CarPoolUserHistory (
+    HistoryID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    ChangedBy INT,
+    ChangeDate VARCHAR(50) NOT NULL,
+    IPAddress VARCHAR(45),
+    Action VARCHAR(50) NOT NULL,
+    FieldName VARCHAR(50) NOT NULL,
+    OldValue VARCHAR(255),
+    NewValue VARCHAR(255),
+    INDEX (UserID, HistoryID),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID),
+    FOREIGN KEY (ChangedBy) REFERENCES CarPoolUser(UserID)
+);
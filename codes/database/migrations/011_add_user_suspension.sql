@@ -0,0 +1,5 @@
+-- Lets admins suspend and reinstate accounts
+USE CAR_POOL;
+
+ALTER TABLE CarPoolUser ADD COLUMN SuspendedDate VARCHAR(50);
+ALTER TABLE CarPoolUser ADD COLUMN SuspensionReason VARCHAR(255);
@@ -0,0 +1,16 @@
+-- Lets users download a copy of their personal data
+USE CAR_POOL;
+
+-- Create the Data Export Table, the personal data archives requested by users
+CREATE TABLE IF NOT EXISTS CarPoolDataExport (
+    ExportID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    Status ENUM('pending', 'ready', 'failed', 'expired') NOT NULL,
+    RequestDate VARCHAR(50) NOT NULL,
+    CompletedDate VARCHAR(50),
+    ExpiryDate VARCHAR(50),
+    FilePath VARCHAR(255),
+    INDEX (UserID, Status),
+    INDEX (Status, ExpiryDate),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
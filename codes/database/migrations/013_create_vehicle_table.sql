@@ -0,0 +1,22 @@
+-- Lets car owners register their vehicles, new trips have to name the vehicle they use
+USE CAR_POOL;
+
+-- Create the Vehicle Table, the cars registered by car owners
+CREATE TABLE IF NOT EXISTS CarPoolVehicle (
+    VehicleID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    Make VARCHAR(50) NOT NULL,
+    Model VARCHAR(50) NOT NULL,
+    Colour VARCHAR(50) NOT NULL,
+    CarPlateNumber VARCHAR(15) NOT NULL,
+    PassengerCapacity INT NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    LastUpdate VARCHAR(50) NOT NULL,
+    RetiredDate VARCHAR(50),
+    INDEX (UserID),
+    INDEX (CarPlateNumber),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
+
+ALTER TABLE CarPoolTrip ADD COLUMN VehicleID INT;
+ALTER TABLE CarPoolTrip ADD FOREIGN KEY (VehicleID) REFERENCES CarPoolVehicle(VehicleID);
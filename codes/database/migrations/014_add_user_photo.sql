@@ -0,0 +1,4 @@
+-- Stores the ID of the profile photo of each user
+USE CAR_POOL;
+
+ALTER TABLE CarPoolUser ADD COLUMN PhotoID CHAR(32);
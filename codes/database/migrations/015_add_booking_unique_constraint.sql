@@ -0,0 +1,27 @@
+-- Lets a passenger book each trip only once
+-- Existing duplicates are removed first, keeping the earliest booking, the query below lists them.
+-- The unique key leaves no room to keep them as cancelled bookings, so the seat each of them held is given back
+-- to its open trip, and a 'fully booked' trip that gets seats back is reopened.
+USE CAR_POOL;
+
+-- SELECT TripID, PassengerID, COUNT(*) FROM CarPoolBooking GROUP BY TripID, PassengerID HAVING COUNT(*) > 1;
+
+UPDATE CarPoolTrip t
+JOIN (
+    SELECT TripID, SUM(Bookings - 1) AS Duplicates
+    FROM (
+        SELECT TripID, PassengerID, COUNT(*) AS Bookings
+        FROM CarPoolBooking
+        GROUP BY TripID, PassengerID
+        HAVING COUNT(*) > 1
+    ) passengers
+    GROUP BY TripID
+) d ON t.TripID = d.TripID
+SET t.AvailableSeats = t.AvailableSeats + d.Duplicates,
+    t.TripStatus = IF(t.TripStatus = 'fully booked', 'created', t.TripStatus)
+WHERE t.TripStatus IN ('created', 'fully booked');
+
+DELETE later FROM CarPoolBooking later
+JOIN CarPoolBooking earlier ON later.TripID = earlier.TripID AND later.PassengerID = earlier.PassengerID AND later.BookingID > earlier.BookingID;
+
+ALTER TABLE CarPoolBooking ADD CONSTRAINT UniqueTripPassenger UNIQUE (TripID, PassengerID);
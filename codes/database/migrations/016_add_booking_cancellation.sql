@@ -0,0 +1,5 @@
+-- Lets passengers cancel their bookings, cancelled bookings are kept for the car owner to see
+USE CAR_POOL;
+
+ALTER TABLE CarPoolBooking ADD COLUMN BookingStatus ENUM('booked', 'cancelled') NOT NULL DEFAULT 'booked';
+ALTER TABLE CarPoolBooking ADD COLUMN CancelledDateTime VARCHAR(50);
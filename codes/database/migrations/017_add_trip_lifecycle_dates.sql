@@ -0,0 +1,5 @@
+-- Records when a trip was started or cancelled, both are set by the trip service
+USE CAR_POOL;
+
+ALTER TABLE CarPoolTrip ADD COLUMN StartedDateTime VARCHAR(50);
+ALTER TABLE CarPoolTrip ADD COLUMN CancelledDateTime VARCHAR(50);
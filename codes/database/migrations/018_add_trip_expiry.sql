@@ -0,0 +1,6 @@
+-- Lets the trip service expire trips that were not started by their start time, with the reason
+USE CAR_POOL;
+
+ALTER TABLE CarPoolTrip MODIFY COLUMN TripStatus ENUM('fully booked', 'cancelled', 'completed', 'created', 'started', 'expired') NOT NULL;
+ALTER TABLE CarPoolTrip ADD COLUMN ExpiredDateTime VARCHAR(50);
+ALTER TABLE CarPoolTrip ADD COLUMN StatusReason VARCHAR(255);
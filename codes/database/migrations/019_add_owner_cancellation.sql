@@ -0,0 +1,5 @@
+-- Lets a trip cancellation cancel its bookings, with the reason given by the car owner
+USE CAR_POOL;
+
+ALTER TABLE CarPoolBooking MODIFY COLUMN BookingStatus ENUM('booked', 'cancelled', 'cancelled by owner') NOT NULL DEFAULT 'booked';
+ALTER TABLE CarPoolBooking ADD COLUMN CancellationReason VARCHAR(255);
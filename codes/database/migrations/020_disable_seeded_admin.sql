@@ -0,0 +1,20 @@
+-- Disables the admin account that older versions of script.sql seeded with a known password.
+-- Its password may have been rehashed on a login, so the account is matched on its email address alone.
+-- It is suspended and deleted rather than only losing its password, which a password reset could restore,
+-- and its sessions are revoked. The bootstrap admin replaces it.
+USE CAR_POOL;
+
+SET @now = DATE_FORMAT(NOW(), '%Y-%m-%d %H:%i:%s');
+
+UPDATE CarPoolUser
+SET UserPassword = '',
+    SuspendedDate = COALESCE(SuspendedDate, @now),
+    SuspensionReason = COALESCE(SuspensionReason, 'Seeded admin account with a published password'),
+    DeletionDate = COALESCE(DeletionDate, @now),
+    LastUpdate = @now
+WHERE EmailAddress = 'admin@example.com';
+
+UPDATE CarPoolSession s
+JOIN CarPoolUser u ON s.UserID = u.UserID
+SET s.RevocationDate = @now
+WHERE u.EmailAddress = 'admin@example.com' AND s.RevocationDate IS NULL;
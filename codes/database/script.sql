@@ -1,11 +1,23 @@
 -- Create the CAR_POOL database
 CREATE DATABASE IF NOT EXISTS CAR_POOL;
 
+USE CAR_POOL;
+DROP TABLE IF EXISTS CarPoolSession;
+DROP TABLE IF EXISTS CarPoolOwnerApplication;
+DROP TABLE IF EXISTS CarPoolUserToken;
+DROP TABLE IF EXISTS CarPoolLoginThrottle;
+DROP TABLE IF EXISTS CarPoolLockout;
+DROP TABLE IF EXISTS CarPoolTwoFactor;
+DROP TABLE IF EXISTS CarPoolRecoveryCode;
+DROP TABLE IF EXISTS CarPoolUserHistory;
+DROP TABLE IF EXISTS CarPoolDataExport;
 USE CAR_POOL;
 DROP TABLE CarPoolBooking;
 USE CAR_POOL;
 DROP TABLE CarPoolTrip;
 USE CAR_POOL;
+DROP TABLE IF EXISTS CarPoolVehicle;
+USE CAR_POOL;
 DROP TABLE CarPoolUser;
 
 
@@ -23,7 +35,152 @@ CREATE TABLE IF NOT EXISTS CarPoolUser (
     CreationDate VARCHAR(50) NOT NULL,
     LastUpdate VARCHAR(50) NOT NULL,
     DeletionDate VARCHAR(50),
-    UserType ENUM('passenger', 'car owner') NOT NULL
+    UserType ENUM('passenger', 'car owner', 'admin') NOT NULL,
+    PurgeDate VARCHAR(50),
+    EmailVerifiedDate VARCHAR(50),
+    SuspendedDate VARCHAR(50),
+    SuspensionReason VARCHAR(255),
+    PhotoID CHAR(32),
+    CONSTRAINT UniqueEmailAddress UNIQUE (EmailAddress),
+    CONSTRAINT UniqueMobileNumber UNIQUE (MobileNumber)
+);
+
+-- Create the Session Table (one row per login, used to refresh and revoke access tokens)
+CREATE TABLE IF NOT EXISTS CarPoolSession (
+    SessionID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    RefreshTokenHash CHAR(64) NOT NULL UNIQUE,
+    DeviceName VARCHAR(255) NOT NULL,
+    IPAddress VARCHAR(45) NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    LastSeen VARCHAR(50) NOT NULL,
+    ExpiryDate VARCHAR(50) NOT NULL,
+    RevocationDate VARCHAR(50),
+    INDEX (UserID, RevocationDate),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the Car Owner Application Table (passengers applying to become car owners, reviewed by an admin)
+CREATE TABLE IF NOT EXISTS CarPoolOwnerApplication (
+    ApplicationID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    DriverLicense VARCHAR(20) NOT NULL,
+    CarPlateNumber VARCHAR(15) NOT NULL,
+    Status ENUM('pending', 'approved', 'rejected') NOT NULL,
+    SubmissionDate VARCHAR(50) NOT NULL,
+    ReviewDate VARCHAR(50),
+    ReviewerID INT,
+    ReviewNote VARCHAR(255),
+    INDEX (UserID, Status),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID),
+    FOREIGN KEY (ReviewerID) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the User Token Table (one-time tokens sent by email)
+CREATE TABLE IF NOT EXISTS CarPoolUserToken (
+    TokenID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    Purpose ENUM('email verification', 'password reset', 'two-factor login') NOT NULL,
+    TokenHash CHAR(64) NOT NULL UNIQUE,
+    CreationDate VARCHAR(50) NOT NULL,
+    ExpiryDate VARCHAR(50) NOT NULL,
+    UsedDate VARCHAR(50),
+    INDEX (UserID, Purpose),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the Login Throttle Table, failed logins counted per email address and per client IP address
+CREATE TABLE IF NOT EXISTS CarPoolLoginThrottle (
+    KeyType ENUM('account', 'ip') NOT NULL,
+    KeyValue VARCHAR(100) NOT NULL,
+    FailureCount INT NOT NULL,
+    LastFailure VARCHAR(50) NOT NULL,
+    BlockedUntil VARCHAR(50),
+    PRIMARY KEY (KeyType, KeyValue)
+);
+
+-- Create the Lockout Table, a record of every lockout for the admins
+CREATE TABLE IF NOT EXISTS CarPoolLockout (
+    LockoutID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    KeyType ENUM('account', 'ip') NOT NULL,
+    KeyValue VARCHAR(100) NOT NULL,
+    UserID INT,
+    FailureCount INT NOT NULL,
+    LockedDate VARCHAR(50) NOT NULL,
+    LockedUntil VARCHAR(50) NOT NULL,
+    ClearedDate VARCHAR(50),
+    ClearedBy INT,
+    INDEX (ClearedDate, LockedUntil),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID),
+    FOREIGN KEY (ClearedBy) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the Two-Factor Table, the TOTP secret of each user who set one up
+CREATE TABLE IF NOT EXISTS CarPoolTwoFactor (
+    UserID INT NOT NULL PRIMARY KEY,
+    Secret VARCHAR(64) NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    EnabledDate VARCHAR(50),
+    LastUsedStep BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the Recovery Code Table, single-use codes for a lost authenticator
+CREATE TABLE IF NOT EXISTS CarPoolRecoveryCode (
+    CodeID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    CodeHash CHAR(64) NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    UsedDate VARCHAR(50),
+    INDEX (UserID),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the User History Table, one row per profile field changed
+CREATE TABLE IF NOT EXISTS CarPoolUserHistory (
+    HistoryID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    ChangedBy INT,
+    ChangeDate VARCHAR(50) NOT NULL,
+    IPAddress VARCHAR(45),
+    Action VARCHAR(50) NOT NULL,
+    FieldName VARCHAR(50) NOT NULL,
+    OldValue VARCHAR(255),
+    NewValue VARCHAR(255),
+    INDEX (UserID, HistoryID),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID),
+    FOREIGN KEY (ChangedBy) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the Data Export Table, the personal data archives requested by users
+CREATE TABLE IF NOT EXISTS CarPoolDataExport (
+    ExportID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    Status ENUM('pending', 'ready', 'failed', 'expired') NOT NULL,
+    RequestDate VARCHAR(50) NOT NULL,
+    CompletedDate VARCHAR(50),
+    ExpiryDate VARCHAR(50),
+    FilePath VARCHAR(255),
+    INDEX (UserID, Status),
+    INDEX (Status, ExpiryDate),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+);
+
+-- Create the Vehicle Table, the cars registered by car owners
+CREATE TABLE IF NOT EXISTS CarPoolVehicle (
+    VehicleID INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    UserID INT NOT NULL,
+    Make VARCHAR(50) NOT NULL,
+    Model VARCHAR(50) NOT NULL,
+    Colour VARCHAR(50) NOT NULL,
+    CarPlateNumber VARCHAR(15) NOT NULL,
+    PassengerCapacity INT NOT NULL,
+    CreationDate VARCHAR(50) NOT NULL,
+    LastUpdate VARCHAR(50) NOT NULL,
+    RetiredDate VARCHAR(50),
+    INDEX (UserID),
+    INDEX (CarPlateNumber),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
 );
 
 -- Create the Trip Table
@@ -35,12 +192,18 @@ CREATE TABLE IF NOT EXISTS CarPoolTrip (
     StartDateTime VARCHAR(50) NOT NULL,
     DestinationAddress VARCHAR(100) NOT NULL,
     AvailableSeats INT NOT NULL,
-    TripStatus ENUM('fully booked', 'cancelled', 'completed', 'created', 'started') NOT NULL,
+    TripStatus ENUM('fully booked', 'cancelled', 'completed', 'created', 'started', 'expired') NOT NULL,
     PublishDate VARCHAR(50) NOT NULL,
 	EstimatedEndDateTime VARCHAR(50), 
 	TripDuration INT NOT NULL, 
 	CompletedDateTime VARCHAR(50),    
-    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID)
+    VehicleID INT,
+    StartedDateTime VARCHAR(50),
+    CancelledDateTime VARCHAR(50),
+    ExpiredDateTime VARCHAR(50),
+    StatusReason VARCHAR(255),
+    FOREIGN KEY (UserID) REFERENCES CarPoolUser(UserID),
+    FOREIGN KEY (VehicleID) REFERENCES CarPoolVehicle(VehicleID)
 );
 
 -- Create the Booking Table
@@ -49,6 +212,10 @@ CREATE TABLE IF NOT EXISTS CarPoolBooking (
     TripID INT NOT NULL,
     PassengerID INT NOT NULL,
     BookingDateTime VARCHAR(50),
+    BookingStatus ENUM('booked', 'cancelled', 'cancelled by owner') NOT NULL DEFAULT 'booked',
+    CancelledDateTime VARCHAR(50),
+    CancellationReason VARCHAR(255),
+    CONSTRAINT UniqueTripPassenger UNIQUE (TripID, PassengerID),
     FOREIGN KEY (BookingID) REFERENCES CarPoolTrip(TripID),
     FOREIGN KEY (PassengerID) REFERENCES CarPoolUser(UserID)
 );
@@ -86,6 +253,17 @@ VALUES
 ('CarOwner10_FirstName', 'CarOwner10_LastName', '9876543219', 'carowner10@example.com', 'password20', 'DL174', '345STU', '2023-03-10', '2023-12-01', 'car owner');
 
 
+-- No admin account is seeded, the user service creates one from ADMIN_EMAIL, ADMIN_MOBILE and ADMIN_PASSWORD on startup
+
+
+-- The seeded accounts have verified email addresses
+UPDATE CarPoolUser SET EmailVerifiedDate = CreationDate WHERE UserID > 0;
+
+
+-- Insert 1 Vehicle per Car Owner
+INSERT INTO CarPoolVehicle (UserID, Make, Model, Colour, CarPlateNumber, PassengerCapacity, CreationDate, LastUpdate)
+SELECT UserID, 'Toyota', 'Corolla Altis', 'White', CarPlateNumber, 5, CreationDate, LastUpdate FROM CarPoolUser WHERE UserType = 'car owner';
+
 -- Insert data into the Trips table
 INSERT INTO CarPoolTrip (UserID, PickupAddress, AltPickupAddress, StartDateTime, DestinationAddress, AvailableSeats, TripStatus, PublishDate, EstimatedEndDateTime, TripDuration, CompletedDateTime)
 VALUES
@@ -124,4 +302,5 @@ VALUES
 (17, 'PickupG', 'AltPickupG', '2024-01-02 17:30:00', 'DestinationG', 4, 'created', '2023-12-10', '2024-01-02 18:10:00', 40, NULL),
 (18, 'PickupH', 'AltPickupH', '2024-01-02 18:00:00', 'DestinationH', 3, 'created', '2023-12-10', '2024-01-02 18:40:00', 40, NULL);
 
-
+-- The seeded trips use the vehicle of their owner
+UPDATE CarPoolTrip t JOIN CarPoolVehicle v ON t.UserID = v.UserID SET t.VehicleID = v.VehicleID WHERE t.TripID > 0;